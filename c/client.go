@@ -0,0 +1,238 @@
+// client.go - C API client
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+#define KATZENPOST_NO_PROTOTYPES
+#include <limits.h>
+#include <stdlib.h>
+#include <string.h>
+#include "katzenpost.h"
+*/
+import "C"
+
+import (
+	"encoding/hex"
+	"time"
+	"unsafe"
+
+	"github.com/katzenpost/bindings/internal/core"
+	"github.com/katzenpost/core/crypto/ecdh"
+)
+
+func getClient(handle C.kp_client) (*core.Client, error) {
+	client, ok := getHandle(uint64(handle)).(*core.Client)
+	if !ok {
+		return nil, errInvalidHandle
+	}
+	return client, nil
+}
+
+// optionalKey returns nil for the 0 handle
+func optionalKey(handle C.kp_key) (*ecdh.PrivateKey, error) {
+	if handle == 0 {
+		return nil, nil
+	}
+	return getKey(handle)
+}
+
+func buildConfig(config *C.kp_config) (*core.Config, error) {
+	identityKey, err := optionalKey(config.identity_key)
+	if err != nil {
+		return nil, err
+	}
+	linkKey, err := optionalKey(config.link_key)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &core.Config{
+		PkiAddress:  goString(config.pki_address),
+		PkiKey:      goString(config.pki_key),
+		User:        goString(config.user),
+		Provider:    goString(config.provider),
+		IdentityKey: identityKey,
+		LinkKey:     linkKey,
+		DataDir:     goString(config.data_dir),
+	}
+	if config.log_level != nil {
+		cfg.Log = &core.LogConfig{
+			File:    goString(config.log_file),
+			Level:   goString(config.log_level),
+			Enabled: true,
+		}
+	}
+	return cfg, nil
+}
+
+//export kp_client_new
+func kp_client_new(config *C.kp_config, handle *C.kp_client, errOut **C.char) C.int {
+	if config == nil || handle == nil {
+		return setError(errOut, invalidArgument("config and client are required"))
+	}
+	if config.struct_size != C.size_t(unsafe.Sizeof(*config)) {
+		return setError(errOut, invalidArgument("config struct_size doesn't match this version of katzenpost.h"))
+	}
+	cfg, err := buildConfig(config)
+	if err != nil {
+		return setError(errOut, err)
+	}
+	client, err := core.New(cfg)
+	if err != nil {
+		return setError(errOut, err)
+	}
+	*handle = C.kp_client(newHandle(client))
+	return C.KP_OK
+}
+
+//export kp_client_load
+func kp_client_load(path *C.char, handle *C.kp_client, errOut **C.char) C.int {
+	if path == nil || handle == nil {
+		return setError(errOut, invalidArgument("config_path and client are required"))
+	}
+	cfg, err := core.LoadConfig(C.GoString(path))
+	if err != nil {
+		return setError(errOut, err)
+	}
+	client, err := core.New(cfg)
+	if err != nil {
+		return setError(errOut, err)
+	}
+	*handle = C.kp_client(newHandle(client))
+	return C.KP_OK
+}
+
+//export kp_client_shutdown
+func kp_client_shutdown(handle C.kp_client) {
+	client, err := getClient(handle)
+	if err != nil {
+		return
+	}
+	freeHandle(uint64(handle))
+	client.Shutdown()
+}
+
+//export kp_client_wait_to_connect
+func kp_client_wait_to_connect(handle C.kp_client, errOut **C.char) C.int {
+	client, err := getClient(handle)
+	if err != nil {
+		return setError(errOut, err)
+	}
+	return setError(errOut, client.WaitToConnect())
+}
+
+//export kp_client_send
+func kp_client_send(handle C.kp_client, account, recipient *C.char, payload *C.uint8_t, payloadLen C.size_t, messageID **C.char, errOut **C.char) C.int {
+	client, err := getClient(handle)
+	if err != nil {
+		return setError(errOut, err)
+	}
+	if recipient == nil || (payload == nil && payloadLen != 0) {
+		return setError(errOut, invalidArgument("recipient and payload are required"))
+	}
+	if payloadLen > C.size_t(C.INT_MAX) {
+		// C.GoBytes takes an int length
+		return setError(errOut, core.ErrMessageTooLarge)
+	}
+
+	from := client.Address()
+	if account != nil {
+		from = C.GoString(account)
+	}
+	msg := C.GoBytes(unsafe.Pointer(payload), C.int(payloadLen))
+	id, err := client.SendFrom(from, C.GoString(recipient), msg)
+	if err != nil {
+		return setError(errOut, err)
+	}
+	if messageID != nil {
+		*messageID = C.CString(hex.EncodeToString(id))
+	}
+	return C.KP_OK
+}
+
+//export kp_client_status
+func kp_client_status(handle C.kp_client, messageID *C.char, status *C.int, errOut **C.char) C.int {
+	client, err := getClient(handle)
+	if err != nil {
+		return setError(errOut, err)
+	}
+	if messageID == nil || status == nil {
+		return setError(errOut, invalidArgument("message_id and status are required"))
+	}
+	id, err := hex.DecodeString(C.GoString(messageID))
+	if err != nil {
+		return setError(errOut, invalidArgument("message_id is not hex encoded"))
+	}
+	s, err := client.Status(id)
+	if err != nil {
+		return setError(errOut, err)
+	}
+	*status = C.int(s)
+	return C.KP_OK
+}
+
+//export kp_client_get_message
+func kp_client_get_message(handle C.kp_client, account *C.char, timeout C.int64_t, message **C.kp_message, errOut **C.char) C.int {
+	client, err := getClient(handle)
+	if err != nil {
+		return setError(errOut, err)
+	}
+	if message == nil {
+		return setError(errOut, invalidArgument("message is required"))
+	}
+
+	to := client.Address()
+	if account != nil {
+		to = C.GoString(account)
+	}
+	msg, err := client.GetMessageFor(to, time.Millisecond*time.Duration(timeout))
+	if err != nil {
+		return setError(errOut, err)
+	}
+	*message = newMessage(msg)
+	return C.KP_OK
+}
+
+// newMessage copies msg into C memory
+func newMessage(msg *core.Message) *C.kp_message {
+	m := (*C.kp_message)(C.calloc(1, C.size_t(unsafe.Sizeof(C.kp_message{}))))
+	m.id = C.CString(msg.ID)
+	m.account = C.CString(msg.Account)
+	m.sender = C.CString(msg.Sender)
+	if msg.SenderKey != nil {
+		m.sender_key = C.CString(msg.SenderKey.String())
+	}
+	if len(msg.Payload) != 0 {
+		m.payload = (*C.uint8_t)(C.CBytes(msg.Payload))
+		m.payload_len = C.size_t(len(msg.Payload))
+	}
+	m.received = C.int64_t(msg.Received.Unix())
+	return m
+}
+
+//export kp_message_free
+func kp_message_free(m *C.kp_message) {
+	if m == nil {
+		return
+	}
+	C.free(unsafe.Pointer(m.id))
+	C.free(unsafe.Pointer(m.account))
+	C.free(unsafe.Pointer(m.sender))
+	C.free(unsafe.Pointer(m.sender_key))
+	C.free(unsafe.Pointer(m.payload))
+	C.free(unsafe.Pointer(m))
+}
@@ -0,0 +1,229 @@
+// client_test.go - C API tests
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+const (
+	testTimeout = 5 * time.Second
+	testPayload = "hello from C"
+
+	// the values of the katzenpost.h enums
+	kpOK                 = 0
+	kpErrInvalidHandle   = 2
+	kpErrInvalidArgument = 3
+	kpErrTimeout         = 4
+	kpErrMessageTooLarge = 7
+	kpErrUnknownMessage  = 8
+)
+
+// newFakeClient starts a client on network and returns its handle, kp_config
+// can't select a fake network
+func newFakeClient(t *testing.T, network *core.FakeNetwork, dataDir, user string) (uint64, string) {
+	client, err := core.New(&core.Config{
+		User:        user,
+		Provider:    "provider",
+		FakeNetwork: network,
+		DataDir:     path.Join(dataDir, user),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newHandle(client), client.Address()
+}
+
+func checkCode(t *testing.T, call string, result cResult, code int) {
+	if result.code != code {
+		t.Errorf("%s returned %s (%q), expected %s", call, testErrorName(result.code), result.err, testErrorName(code))
+	}
+	if code != kpOK && result.err == "" {
+		t.Errorf("%s didn't describe the error", call)
+	}
+}
+
+func TestErrorName(t *testing.T) {
+	names := map[int]string{
+		kpOK:                 "OK",
+		kpErrInvalidHandle:   "InvalidHandle",
+		kpErrMessageTooLarge: "MessageTooLarge",
+		1000:                 "Unknown",
+	}
+	for code, name := range names {
+		if got := testErrorName(code); got != name {
+			t.Errorf("Got name %q for %d, expected %q", got, code, name)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	key, result := testKeyGenerate()
+	checkCode(t, "kp_key_generate", result, kpOK)
+	public, ok := testKeyPublic(key)
+	if !ok || public == "" {
+		t.Fatal("No public key")
+	}
+	private, ok := testKeyPrivateHex(key)
+	if !ok {
+		t.Fatal("No private key")
+	}
+
+	loaded, result := testKeyFromHex(private)
+	checkCode(t, "kp_key_from_hex", result, kpOK)
+	if loaded == key {
+		t.Error("The loaded key got the same handle")
+	}
+	if loadedPublic, _ := testKeyPublic(loaded); loadedPublic != public {
+		t.Errorf("Got public key %s, expected %s", loadedPublic, public)
+	}
+
+	testKeyFree(key)
+	testKeyFree(loaded)
+	if _, ok := testKeyPublic(key); ok {
+		t.Error("Got the public key of a freed handle")
+	}
+	if _, ok := testKeyPrivateHex(loaded); ok {
+		t.Error("Got the private key of a freed handle")
+	}
+
+	_, result = testKeyFromHex("")
+	checkCode(t, "kp_key_from_hex(NULL)", result, kpErrInvalidArgument)
+	_, result = testKeyFromHex("not hex")
+	if result.code == kpOK {
+		t.Error("Loaded an invalid hex key")
+	}
+}
+
+func TestClientNewStructSize(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "katzenpost-c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	for _, delta := range []int{-8, 8} {
+		_, result := testClientNew("alice", "provider", dataDir, delta)
+		checkCode(t, "kp_client_new", result, kpErrInvalidArgument)
+	}
+
+	// the right size gets past the check
+	client, result := testClientNew("alice", "provider", dataDir, 0)
+	if result.code == kpOK {
+		testClientShutdown(client)
+	}
+	if result.code == kpErrInvalidArgument {
+		t.Errorf("kp_client_new rejected the right struct_size: %s", result.err)
+	}
+}
+
+func TestClientSendReceive(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "katzenpost-c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	network := core.NewFakeNetwork(10*time.Millisecond, 0)
+	alice, aliceAddress := newFakeClient(t, network, dataDir, "alice")
+	defer testClientShutdown(alice)
+	bob, bobAddress := newFakeClient(t, network, dataDir, "bob")
+	defer testClientShutdown(bob)
+
+	messageID, result := testSend(alice, "", bobAddress, []byte(testPayload), uint64(len(testPayload)))
+	checkCode(t, "kp_client_send", result, kpOK)
+	if messageID == "" {
+		t.Fatal("No message ID")
+	}
+	status, result := testStatus(alice, messageID)
+	checkCode(t, "kp_client_status", result, kpOK)
+	if status != core.StatusQueued && status != core.StatusSent && status != core.StatusAcknowledged {
+		t.Errorf("Got status %v", status)
+	}
+
+	msg, senderKey, result := testGetMessage(bob, "", testTimeout)
+	checkCode(t, "kp_client_get_message", result, kpOK)
+	if msg == nil {
+		t.Fatal("No message")
+	}
+	if string(msg.Payload) != testPayload {
+		t.Errorf("Got payload %q, expected %q", msg.Payload, testPayload)
+	}
+	if msg.Sender != aliceAddress || msg.Account != bobAddress || msg.ID == "" || senderKey == "" {
+		t.Errorf("Got message %+v with sender key %q", msg, senderKey)
+	}
+	if time.Since(msg.Received) > time.Minute {
+		t.Errorf("Got received time %v", msg.Received)
+	}
+
+	// an empty payload can be NULL
+	_, result = testSend(alice, aliceAddress, bobAddress, nil, 0)
+	checkCode(t, "kp_client_send(NULL, 0)", result, kpOK)
+	msg, _, result = testGetMessage(bob, bobAddress, testTimeout)
+	checkCode(t, "kp_client_get_message", result, kpOK)
+	if msg != nil && len(msg.Payload) != 0 {
+		t.Errorf("Got payload %q, expected an empty one", msg.Payload)
+	}
+
+	_, _, result = testGetMessage(bob, "", 10*time.Millisecond)
+	checkCode(t, "kp_client_get_message", result, kpErrTimeout)
+}
+
+func TestClientErrors(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "katzenpost-c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	network := core.NewFakeNetwork(10*time.Millisecond, 0)
+	alice, _ := newFakeClient(t, network, dataDir, "alice")
+	defer testClientShutdown(alice)
+	bob, bobAddress := newFakeClient(t, network, dataDir, "bob")
+	defer testClientShutdown(bob)
+
+	// the length is rejected before the payload is read
+	_, result := testSend(alice, "", bobAddress, []byte(testPayload), math.MaxInt32+1)
+	checkCode(t, "kp_client_send(INT_MAX+1)", result, kpErrMessageTooLarge)
+	_, result = testSend(alice, "", bobAddress, nil, 1)
+	checkCode(t, "kp_client_send(NULL, 1)", result, kpErrInvalidArgument)
+	_, result = testSend(alice, "", "", []byte(testPayload), uint64(len(testPayload)))
+	checkCode(t, "kp_client_send(recipient NULL)", result, kpErrInvalidArgument)
+
+	_, result = testStatus(alice, "not hex")
+	checkCode(t, "kp_client_status(not hex)", result, kpErrInvalidArgument)
+	_, result = testStatus(alice, "00112233")
+	checkCode(t, "kp_client_status(unknown)", result, kpErrUnknownMessage)
+
+	key, _ := testKeyGenerate()
+	defer testKeyFree(key)
+	for _, handle := range []uint64{0, key, 1 << 40} {
+		_, result = testSend(handle, "", bobAddress, []byte(testPayload), uint64(len(testPayload)))
+		checkCode(t, "kp_client_send(invalid handle)", result, kpErrInvalidHandle)
+		_, _, result = testGetMessage(handle, "", time.Millisecond)
+		checkCode(t, "kp_client_get_message(invalid handle)", result, kpErrInvalidHandle)
+	}
+
+	testClientShutdown(alice)
+	_, result = testSend(alice, "", bobAddress, []byte(testPayload), uint64(len(testPayload)))
+	checkCode(t, "kp_client_send(after shutdown)", result, kpErrInvalidHandle)
+}
@@ -0,0 +1,106 @@
+// handler.go - C API callbacks
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+#define KATZENPOST_NO_PROTOTYPES
+#include <stdlib.h>
+#include "katzenpost.h"
+
+// go can't call C function pointers directly
+
+static void call_message_cb(kp_message_cb cb, void *userdata, kp_message *message) {
+	cb(userdata, message);
+}
+
+static void call_ack_cb(kp_ack_cb cb, void *userdata, char *message_id, char *error) {
+	cb(userdata, message_id, error);
+}
+
+static void call_connection_cb(kp_connection_cb cb, void *userdata, int connected, char *error) {
+	cb(userdata, connected, error);
+}
+*/
+import "C"
+
+import (
+	"encoding/hex"
+	"unsafe"
+
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+type callbackHandler struct {
+	onMessage    C.kp_message_cb
+	onACK        C.kp_ack_cb
+	onConnection C.kp_connection_cb
+	userdata     unsafe.Pointer
+}
+
+func (h *callbackHandler) ReceivedMessage(msg *core.Message) {
+	m := newMessage(msg)
+	defer kp_message_free(m)
+	C.call_message_cb(h.onMessage, h.userdata, m)
+}
+
+func (h *callbackHandler) ReceivedACK(messageID []byte, err error) {
+	if h.onACK == nil {
+		return
+	}
+	id := C.CString(hex.EncodeToString(messageID))
+	defer C.free(unsafe.Pointer(id))
+	var errStr *C.char
+	if err != nil {
+		errStr = C.CString(err.Error())
+		defer C.free(unsafe.Pointer(errStr))
+	}
+	C.call_ack_cb(h.onACK, h.userdata, id, errStr)
+}
+
+func (h *callbackHandler) ConnectionChanged(isConnected bool, err error) {
+	if h.onConnection == nil {
+		return
+	}
+	connected := C.int(0)
+	if isConnected {
+		connected = 1
+	}
+	var errStr *C.char
+	if err != nil {
+		errStr = C.CString(err.Error())
+		defer C.free(unsafe.Pointer(errStr))
+	}
+	C.call_connection_cb(h.onConnection, h.userdata, connected, errStr)
+}
+
+//export kp_client_set_handler
+func kp_client_set_handler(handle C.kp_client, onMessage C.kp_message_cb, onACK C.kp_ack_cb, onConnection C.kp_connection_cb, userdata unsafe.Pointer, errOut **C.char) C.int {
+	client, err := getClient(handle)
+	if err != nil {
+		return setError(errOut, err)
+	}
+	if onMessage == nil && onACK == nil && onConnection == nil {
+		client.SetHandler(nil)
+		return C.KP_OK
+	}
+	if onMessage == nil {
+		// the core handler always receives the messages
+		return setError(errOut, invalidArgument("on_message is required with other callbacks"))
+	}
+	client.SetHandler(&callbackHandler{onMessage, onACK, onConnection, userdata})
+	return C.KP_OK
+}
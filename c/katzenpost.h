@@ -0,0 +1,161 @@
+/*
+ * katzenpost.h - C API of the katzenpost mixnet client
+ * Copyright (C) 2018  Ruben Pollan.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/*
+ * Clients and keys are opaque handles, 0 is never a valid handle. Every
+ * function returning int returns KP_OK on success or one of the KP_ERR
+ * codes, if error is not NULL it's set to a description of the failure
+ * that has to be released with kp_free_string. Strings returned by the
+ * library are owned by the caller and released with kp_free_string.
+ *
+ * Callbacks are called from threads created by the library, the data they
+ * receive is only valid until they return.
+ */
+
+#ifndef KATZENPOST_H
+#define KATZENPOST_H
+
+#include <stddef.h>
+#include <stdint.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+typedef uint64_t kp_client;
+typedef uint64_t kp_key;
+
+/* Error codes */
+enum {
+	KP_OK = 0,
+	KP_ERR_GENERIC = 1,
+	KP_ERR_INVALID_HANDLE = 2,
+	KP_ERR_INVALID_ARGUMENT = 3,
+	KP_ERR_TIMEOUT = 4,
+	KP_ERR_SHUTDOWN = 5,
+	KP_ERR_UNKNOWN_ACCOUNT = 6,
+	KP_ERR_MESSAGE_TOO_LARGE = 7,
+	KP_ERR_UNKNOWN_MESSAGE = 8
+};
+
+/* Delivery status of sent messages */
+enum {
+	KP_STATUS_QUEUED = 0,
+	KP_STATUS_SENT = 1,
+	KP_STATUS_ACKNOWLEDGED = 2,
+	KP_STATUS_FAILED = 3
+};
+
+/*
+ * Client configuration, NULL strings are left unset. struct_size has to be
+ * set to sizeof(kp_config), the library uses it to detect callers built with
+ * a different version of this header. New fields are only added at the end:
+ *
+ *   kp_config config = { sizeof(kp_config) };
+ */
+typedef struct {
+	size_t struct_size;
+	const char *pki_address;
+	const char *pki_key;
+	const char *user;
+	const char *provider;
+	kp_key identity_key;
+	kp_key link_key;
+	const char *data_dir;
+	const char *log_file;
+	const char *log_level;
+} kp_config;
+
+/* Received message, received is a unix timestamp */
+typedef struct {
+	char *id;
+	char *account;
+	char *sender;
+	char *sender_key;
+	uint8_t *payload;
+	size_t payload_len;
+	int64_t received;
+} kp_message;
+
+typedef void (*kp_message_cb)(void *userdata, const kp_message *message);
+typedef void (*kp_ack_cb)(void *userdata, const char *message_id, const char *error);
+typedef void (*kp_connection_cb)(void *userdata, int connected, const char *error);
+
+#ifndef KATZENPOST_NO_PROTOTYPES
+
+/* kp_free_string releases a string returned by the library */
+void kp_free_string(char *str);
+
+/* kp_error_name returns a static name for an error code */
+const char *kp_error_name(int code);
+
+/* Keys */
+int kp_key_generate(kp_key *key, char **error);
+int kp_key_from_hex(const char *hex, kp_key *key, char **error);
+char *kp_key_public(kp_key key);
+char *kp_key_private_hex(kp_key key);
+void kp_key_free(kp_key key);
+
+/* kp_client_new connects a client, the keys in config can be freed after */
+int kp_client_new(const kp_config *config, kp_client *client, char **error);
+
+/* kp_client_load connects a client with a mailproxy configuration file */
+int kp_client_load(const char *config_path, kp_client *client, char **error);
+
+/* kp_client_shutdown stops the client and releases the handle */
+void kp_client_shutdown(kp_client client);
+
+int kp_client_wait_to_connect(kp_client client, char **error);
+
+/*
+ * kp_client_send sends payload from account, NULL for the default one. The
+ * hex encoded message ID is stored in message_id if not NULL. Payloads
+ * longer than INT_MAX fail with KP_ERR_MESSAGE_TOO_LARGE.
+ */
+int kp_client_send(kp_client client, const char *account, const char *recipient,
+                   const uint8_t *payload, size_t payload_len,
+                   char **message_id, char **error);
+
+/* kp_client_status stores the delivery status of message_id in status */
+int kp_client_status(kp_client client, const char *message_id, int *status, char **error);
+
+/*
+ * kp_client_get_message waits up to timeout_ms for a message to account,
+ * NULL for the default one. A timeout of 0 waits forever. The message has
+ * to be released with kp_message_free.
+ */
+int kp_client_get_message(kp_client client, const char *account, int64_t timeout_ms,
+                          kp_message **message, char **error);
+void kp_message_free(kp_message *message);
+
+/*
+ * kp_client_set_handler registers callbacks for received messages, ACKs and
+ * connection changes, on_ack and on_connection can be NULL. While a handler
+ * is set messages are not returned by kp_client_get_message. Passing all
+ * NULL goes back to polling.
+ */
+int kp_client_set_handler(kp_client client, kp_message_cb on_message, kp_ack_cb on_ack,
+                          kp_connection_cb on_connection, void *userdata, char **error);
+
+#endif /* KATZENPOST_NO_PROTOTYPES */
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* KATZENPOST_H */
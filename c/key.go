@@ -0,0 +1,87 @@
+// key.go - C API keys
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+#define KATZENPOST_NO_PROTOTYPES
+#include "katzenpost.h"
+*/
+import "C"
+
+import (
+	"github.com/katzenpost/bindings/internal/core"
+	"github.com/katzenpost/core/crypto/ecdh"
+)
+
+func getKey(handle C.kp_key) (*ecdh.PrivateKey, error) {
+	key, ok := getHandle(uint64(handle)).(*ecdh.PrivateKey)
+	if !ok {
+		return nil, errInvalidHandle
+	}
+	return key, nil
+}
+
+//export kp_key_generate
+func kp_key_generate(handle *C.kp_key, errOut **C.char) C.int {
+	if handle == nil {
+		return setError(errOut, invalidArgument("key"))
+	}
+	key, err := core.GenKey()
+	if err != nil {
+		return setError(errOut, err)
+	}
+	*handle = C.kp_key(newHandle(key))
+	return C.KP_OK
+}
+
+//export kp_key_from_hex
+func kp_key_from_hex(hex *C.char, handle *C.kp_key, errOut **C.char) C.int {
+	if hex == nil || handle == nil {
+		return setError(errOut, invalidArgument("hex and key are required"))
+	}
+	key, err := core.HexToKey(C.GoString(hex))
+	if err != nil {
+		return setError(errOut, err)
+	}
+	*handle = C.kp_key(newHandle(key))
+	return C.KP_OK
+}
+
+//export kp_key_public
+func kp_key_public(handle C.kp_key) *C.char {
+	key, err := getKey(handle)
+	if err != nil {
+		return nil
+	}
+	return C.CString(key.PublicKey().String())
+}
+
+//export kp_key_private_hex
+func kp_key_private_hex(handle C.kp_key) *C.char {
+	key, err := getKey(handle)
+	if err != nil {
+		return nil
+	}
+	return C.CString(core.KeyToHex(key))
+}
+
+//export kp_key_free
+func kp_key_free(handle C.kp_key) {
+	if _, err := getKey(handle); err == nil {
+		freeHandle(uint64(handle))
+	}
+}
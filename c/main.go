@@ -0,0 +1,140 @@
+// main.go - C API of the mixnet client
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main builds the client as a C shared library, the API is
+// documented in katzenpost.h:
+//
+//	go build -buildmode=c-shared -o libkatzenpost.so ./c
+package main
+
+/*
+#define KATZENPOST_NO_PROTOTYPES
+#include <stdlib.h>
+#include "katzenpost.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"sync"
+	"unsafe"
+
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+var errInvalidHandle = errors.New("Invalid handle")
+
+// handles maps the opaque handles given to C to the go objects, go pointers
+// can't be kept by C code
+var handles = struct {
+	sync.Mutex
+	next    uint64
+	objects map[uint64]interface{}
+}{objects: make(map[uint64]interface{})}
+
+func newHandle(obj interface{}) uint64 {
+	handles.Lock()
+	defer handles.Unlock()
+	handles.next++
+	handles.objects[handles.next] = obj
+	return handles.next
+}
+
+func getHandle(handle uint64) interface{} {
+	handles.Lock()
+	defer handles.Unlock()
+	return handles.objects[handle]
+}
+
+func freeHandle(handle uint64) {
+	handles.Lock()
+	defer handles.Unlock()
+	delete(handles.objects, handle)
+}
+
+func errorCode(err error) C.int {
+	switch err {
+	case nil:
+		return C.KP_OK
+	case errInvalidHandle:
+		return C.KP_ERR_INVALID_HANDLE
+	case core.ErrTimeout:
+		return C.KP_ERR_TIMEOUT
+	case core.ErrShutdown:
+		return C.KP_ERR_SHUTDOWN
+	case core.ErrUnknownAccount:
+		return C.KP_ERR_UNKNOWN_ACCOUNT
+	case core.ErrMessageTooLarge:
+		return C.KP_ERR_MESSAGE_TOO_LARGE
+	case core.ErrUnknownMessage:
+		return C.KP_ERR_UNKNOWN_MESSAGE
+	}
+	if _, ok := err.(invalidArgument); ok {
+		return C.KP_ERR_INVALID_ARGUMENT
+	}
+	return C.KP_ERR_GENERIC
+}
+
+type invalidArgument string
+
+func (e invalidArgument) Error() string {
+	return "Invalid argument: " + string(e)
+}
+
+// setError returns the error code of err storing its description in errOut
+func setError(errOut **C.char, err error) C.int {
+	if err != nil && errOut != nil {
+		*errOut = C.CString(err.Error())
+	}
+	return errorCode(err)
+}
+
+// goString converts C strings, NULL is the empty string
+func goString(str *C.char) string {
+	if str == nil {
+		return ""
+	}
+	return C.GoString(str)
+}
+
+//export kp_free_string
+func kp_free_string(str *C.char) {
+	C.free(unsafe.Pointer(str))
+}
+
+var errorNames = map[C.int]*C.char{
+	C.KP_OK:                    C.CString("OK"),
+	C.KP_ERR_GENERIC:           C.CString("Error"),
+	C.KP_ERR_INVALID_HANDLE:    C.CString("InvalidHandle"),
+	C.KP_ERR_INVALID_ARGUMENT:  C.CString("InvalidArgument"),
+	C.KP_ERR_TIMEOUT:           C.CString("Timeout"),
+	C.KP_ERR_SHUTDOWN:          C.CString("Shutdown"),
+	C.KP_ERR_UNKNOWN_ACCOUNT:   C.CString("UnknownAccount"),
+	C.KP_ERR_MESSAGE_TOO_LARGE: C.CString("MessageTooLarge"),
+	C.KP_ERR_UNKNOWN_MESSAGE:   C.CString("UnknownMessage"),
+}
+
+var unknownErrorName = C.CString("Unknown")
+
+//export kp_error_name
+func kp_error_name(code C.int) *C.char {
+	if name, ok := errorNames[code]; ok {
+		return name
+	}
+	return unknownErrorName
+}
+
+func main() {}
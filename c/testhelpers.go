@@ -0,0 +1,168 @@
+// testhelpers.go - C API wrappers for the tests
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// cgo can't be used in the test files, these helpers call the exported
+// functions with C memory and return go values to client_test.go. They are
+// not reachable from the library and get dropped by the linker.
+
+/*
+#define KATZENPOST_NO_PROTOTYPES
+#include <stdlib.h>
+#include "katzenpost.h"
+*/
+import "C"
+
+import (
+	"time"
+	"unsafe"
+
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+// cResult is the error code and description returned by a call
+type cResult struct {
+	code int
+	err  string
+}
+
+func newCResult(code C.int, errStr *C.char) cResult {
+	defer C.free(unsafe.Pointer(errStr))
+	return cResult{int(code), goString(errStr)}
+}
+
+// cString returns NULL for the empty string, it has to be freed
+func cString(str string) *C.char {
+	if str == "" {
+		return nil
+	}
+	return C.CString(str)
+}
+
+// takeString converts and frees a string returned by the library
+func takeString(str *C.char) (string, bool) {
+	if str == nil {
+		return "", false
+	}
+	defer kp_free_string(str)
+	return C.GoString(str), true
+}
+
+func testErrorName(code int) string {
+	return C.GoString(kp_error_name(C.int(code)))
+}
+
+func testKeyGenerate() (uint64, cResult) {
+	var key C.kp_key
+	var errStr *C.char
+	code := kp_key_generate(&key, &errStr)
+	return uint64(key), newCResult(code, errStr)
+}
+
+func testKeyFromHex(hex string) (uint64, cResult) {
+	cHex := cString(hex)
+	defer C.free(unsafe.Pointer(cHex))
+	var key C.kp_key
+	var errStr *C.char
+	code := kp_key_from_hex(cHex, &key, &errStr)
+	return uint64(key), newCResult(code, errStr)
+}
+
+func testKeyPublic(key uint64) (string, bool) {
+	return takeString(kp_key_public(C.kp_key(key)))
+}
+
+func testKeyPrivateHex(key uint64) (string, bool) {
+	return takeString(kp_key_private_hex(C.kp_key(key)))
+}
+
+func testKeyFree(key uint64) {
+	kp_key_free(C.kp_key(key))
+}
+
+// testClientNew builds a kp_config with struct_size off by sizeDelta
+func testClientNew(user, provider, dataDir string, sizeDelta int) (uint64, cResult) {
+	config := (*C.kp_config)(C.calloc(1, C.size_t(unsafe.Sizeof(C.kp_config{}))))
+	defer C.free(unsafe.Pointer(config))
+	config.struct_size = C.size_t(int(unsafe.Sizeof(*config)) + sizeDelta)
+	config.user = cString(user)
+	defer C.free(unsafe.Pointer(config.user))
+	config.provider = cString(provider)
+	defer C.free(unsafe.Pointer(config.provider))
+	config.data_dir = cString(dataDir)
+	defer C.free(unsafe.Pointer(config.data_dir))
+
+	var client C.kp_client
+	var errStr *C.char
+	code := kp_client_new(config, &client, &errStr)
+	return uint64(client), newCResult(code, errStr)
+}
+
+func testClientShutdown(client uint64) {
+	kp_client_shutdown(C.kp_client(client))
+}
+
+// testSend passes payloadLen as the length of payload, a nil payload is NULL
+func testSend(client uint64, account, recipient string, payload []byte, payloadLen uint64) (string, cResult) {
+	cAccount := cString(account)
+	defer C.free(unsafe.Pointer(cAccount))
+	cRecipient := cString(recipient)
+	defer C.free(unsafe.Pointer(cRecipient))
+	var cPayload unsafe.Pointer
+	if payload != nil {
+		cPayload = C.CBytes(payload)
+		defer C.free(cPayload)
+	}
+
+	var messageID, errStr *C.char
+	code := kp_client_send(C.kp_client(client), cAccount, cRecipient, (*C.uint8_t)(cPayload), C.size_t(payloadLen), &messageID, &errStr)
+	id, _ := takeString(messageID)
+	return id, newCResult(code, errStr)
+}
+
+func testStatus(client uint64, messageID string) (core.Status, cResult) {
+	cID := cString(messageID)
+	defer C.free(unsafe.Pointer(cID))
+	var status C.int
+	var errStr *C.char
+	code := kp_client_status(C.kp_client(client), cID, &status, &errStr)
+	return core.Status(status), newCResult(code, errStr)
+}
+
+// testGetMessage copies the kp_message into a core.Message, the sender key
+// is returned as a string
+func testGetMessage(client uint64, account string, timeout time.Duration) (*core.Message, string, cResult) {
+	cAccount := cString(account)
+	defer C.free(unsafe.Pointer(cAccount))
+	var message *C.kp_message
+	var errStr *C.char
+	code := kp_client_get_message(C.kp_client(client), cAccount, C.int64_t(timeout/time.Millisecond), &message, &errStr)
+	result := newCResult(code, errStr)
+	if message == nil {
+		return nil, "", result
+	}
+	defer kp_message_free(message)
+
+	msg := &core.Message{
+		ID:       goString(message.id),
+		Account:  goString(message.account),
+		Sender:   goString(message.sender),
+		Received: time.Unix(int64(message.received), 0),
+		Payload:  C.GoBytes(unsafe.Pointer(message.payload), C.int(message.payload_len)),
+	}
+	return msg, goString(message.sender_key), result
+}
@@ -0,0 +1,105 @@
+// main.go - katzenpost client daemon
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Command katzenpost-daemon runs one mixnet client and shares it with the
+// local applications over JSON-RPC on a Unix domain socket. The methods are
+// the ones of the daemon session, like "Katzenpost.Send".
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/katzenpost/bindings/internal/core"
+	"github.com/katzenpost/bindings/internal/daemon"
+)
+
+func main() {
+	cfgFile := flag.String("f", "katzenpost.toml", "Path to the mailproxy configuration file")
+	socketPath := flag.String("socket", "", "Path of the unix socket, defaults to katzenpost.sock in the data dir")
+	allowUIDs := flag.String("allow-uid", "", "Comma separated list of other user IDs allowed to connect")
+	flag.Parse()
+
+	if err := run(*cfgFile, *socketPath, *allowUIDs); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+}
+
+// run serves the client until SIGINT or SIGTERM, the client is shut down
+// and the socket removed before returning
+func run(cfgFile, socketPath, allowUIDs string) error {
+	uids, err := parseUIDs(allowUIDs)
+	if err != nil {
+		return fmt.Errorf("Invalid -allow-uid: %v", err)
+	}
+
+	cfg, err := core.LoadConfig(cfgFile)
+	if err != nil {
+		return fmt.Errorf("Can't load the configuration: %v", err)
+	}
+	if socketPath == "" {
+		socketPath = path.Join(cfg.DataDir, "katzenpost.sock")
+	}
+
+	client, err := core.New(cfg)
+	if err != nil {
+		return fmt.Errorf("Can't start the client: %v", err)
+	}
+	defer client.Shutdown()
+
+	d, err := daemon.New(client, socketPath, uids)
+	if err != nil {
+		return fmt.Errorf("Can't listen on %s: %v", socketPath, err)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		d.Close()
+	}()
+
+	log.Printf("Serving %s on %s", client.Address(), socketPath)
+	if err := d.Serve(); err != nil {
+		d.Close()
+		return fmt.Errorf("Serve failed: %v", err)
+	}
+	return nil
+}
+
+func parseUIDs(list string) ([]uint32, error) {
+	var uids []uint32
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		uid, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%v is not a user ID", field)
+		}
+		uids = append(uids, uint32(uid))
+	}
+	return uids, nil
+}
@@ -16,10 +16,16 @@
 # You should have received a copy of the GNU Affero General Public License
 # along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
+import getpass
+
 import katzenpost
 
-linkKey = "4d488962dd5a7c2d2d2360a6bbe258bf75022eb39a05b8c877f3f92e99fd298c"
-key = katzenpost.StringToKey(linkKey)
+passphrase = getpass.getpass("Keystore passphrase: ")
+keystore = katzenpost.OpenKeystore("")
+try:
+    key = keystore.UnlockKey("alice@example.com/link", passphrase)
+except RuntimeError:
+    key = keystore.GenerateKey("alice@example.com/link", passphrase)
 
 cfg = katzenpost.Config(
     PkiAddress="192.0.2.1:29483",
@@ -32,18 +38,18 @@ cfg = katzenpost.Config(
 
 c = katzenpost.New(cfg)
 
-mail = """From: alice@example.com
-To: bob@panoramix.com
-Subject: hello
-
-Hello there.
-"""
-c.Send("bob@panoramix.com", mail)
+mail = katzenpost.Mail(
+    To="bob@panoramix.com",
+    Subject="hello",
+    Body="Hello there.\n"
+)
+c.SendMail(mail)
 
 while True:
     try:
         m = c.GetMessage(1)
     except RuntimeError:
         continue
-    print("=================>" + m.Sender)
-    print(m.Payload)
+    mail = m.Parse()
+    print("=================>" + mail.From + ": " + mail.Subject)
+    print(mail.Body)
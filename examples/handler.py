@@ -0,0 +1,59 @@
+#!/usr/bin/env python
+# handler.py - python example of a callback based mixnet client
+# Copyright (C) 2018  Ruben Pollan.
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import getpass
+import time
+
+import katzenpost
+
+
+class Handler(katzenpost.MessageHandler):
+    def ReceivedMessage(self, m):
+        print("=================>" + m.Sender)
+        print(m.Payload)
+
+    def ReceivedACK(self, messageID, err):
+        if err:
+            print("message %s failed: %s" % (messageID, err))
+        else:
+            print("message %s delivered" % (messageID,))
+
+    def ConnectionChanged(self, isConnected):
+        print("connected: %s" % (isConnected,))
+
+
+passphrase = getpass.getpass("Keystore passphrase: ")
+keystore = katzenpost.OpenKeystore("")
+try:
+    key = keystore.UnlockKey("alice@example.com/link", passphrase)
+except RuntimeError:
+    key = keystore.GenerateKey("alice@example.com/link", passphrase)
+
+cfg = katzenpost.Config(
+    PkiAddress="192.0.2.1:29483",
+    PkiKey="900895721381C0756D28954524BB1D090F54C8DD9295F84B1D8A93F1E3C17AD8",
+    User="alice",
+    LinkKey=key,
+    Provider="example.com",
+    Log=katzenpost.LogConfig()
+)
+
+c = katzenpost.New(cfg)
+c.SetHandler(Handler())
+
+while True:
+    time.sleep(60)
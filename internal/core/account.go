@@ -0,0 +1,200 @@
+// account.go - mixnet client accounts
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/mailproxy/config"
+)
+
+var (
+	// ErrUnknownAccount is returned when using an account not hosted by
+	// the client
+	ErrUnknownAccount = errors.New("Unknown account")
+
+	// ErrAccountExists is returned when adding an account twice
+	ErrAccountExists = errors.New("Account already exists")
+)
+
+// Account is a user on a provider hosted by the client
+type Account struct {
+	User        string
+	Provider    string
+	IdentityKey *ecdh.PrivateKey
+	LinkKey     *ecdh.PrivateKey
+
+	// ProviderKeyPin is the identity key of the provider, if set the
+	// mailproxy refuses to connect when it doesn't match the PKI document
+	ProviderKeyPin string
+
+	// StorageKey encrypts the mailproxy spool of the account
+	StorageKey *ecdh.PrivateKey
+
+	// InsecureKeyDiscovery lets the mailproxy fetch in cleartext the keys
+	// of the recipients of messages sent through the SMTP listener
+	InsecureKeyDiscovery bool
+}
+
+// Address returns the user@provider address of the account
+func (a *Account) Address() string {
+	return normalizeAddress(fmt.Sprintf("%s@%s", a.User, a.Provider))
+}
+
+func (a *Account) toProxy() (*config.Account, error) {
+	account := &config.Account{
+		User:                 a.User,
+		Provider:             a.Provider,
+		Authority:            pkiName,
+		IdentityKey:          a.IdentityKey,
+		LinkKey:              a.LinkKey,
+		StorageKey:           a.StorageKey,
+		InsecureKeyDiscovery: a.InsecureKeyDiscovery,
+	}
+	if a.ProviderKeyPin != "" {
+		var pin eddsa.PublicKey
+		if err := pin.FromString(a.ProviderKeyPin); err != nil {
+			return nil, fmt.Errorf("Invalid ProviderKeyPin %v: %v", a.ProviderKeyPin, err)
+		}
+		account.ProviderKeyPin = &pin
+	}
+	return account, nil
+}
+
+// normalizeAddress matches the mailproxy account IDs, that are not case
+// sensitive.
+func normalizeAddress(address string) string {
+	return strings.ToLower(address)
+}
+
+// Accounts returns the addresses of all the accounts hosted by the client
+func (c *Client) Accounts() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	addresses := make([]string, 0, len(c.accounts))
+	for address := range c.accounts {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// AddAccount adds a new account to the client. The mailproxy can't add
+// accounts on the fly, so it gets restarted with the new account list.
+// Messages waiting in the spools are kept on disk and not lost.
+func (c *Client) AddAccount(account *Account) error {
+	address := account.Address()
+
+	c.restartLock.Lock()
+	defer c.restartLock.Unlock()
+
+	c.lock.Lock()
+	if _, ok := c.accounts[address]; ok {
+		c.lock.Unlock()
+		return ErrAccountExists
+	}
+	c.accounts[address] = account
+	c.recvCh[address] = make(chan bool, 1)
+	c.lock.Unlock()
+
+	return c.restartProxy(func() {
+		delete(c.accounts, address)
+		delete(c.recvCh, address)
+	})
+}
+
+// RemoveAccount removes an account from the client, the default account
+// can't be removed
+func (c *Client) RemoveAccount(address string) error {
+	address = normalizeAddress(address)
+	if address == c.address {
+		return errors.New("Can't remove the default account")
+	}
+
+	c.restartLock.Lock()
+	defer c.restartLock.Unlock()
+
+	c.lock.Lock()
+	account, ok := c.accounts[address]
+	if !ok {
+		c.lock.Unlock()
+		return ErrUnknownAccount
+	}
+	delete(c.accounts, address)
+	c.lock.Unlock()
+
+	err := c.restartProxy(func() {
+		c.accounts[address] = account
+	})
+	if err == nil {
+		c.lock.Lock()
+		delete(c.recvCh, address)
+		c.lock.Unlock()
+	}
+	return err
+}
+
+// restartProxy has to be called holding restartLock but not the lock, the
+// proxies emit events while starting and shutting down and the event handler
+// takes the lock. If the new account list doesn't work rollback is called,
+// holding the lock, to restore the previous one. No proxy is started once
+// the client is shut down.
+func (c *Client) restartProxy(rollback func()) error {
+	if c.State() == StateShutdown {
+		c.lock.Lock()
+		rollback()
+		c.lock.Unlock()
+		return ErrShutdown
+	}
+
+	// ignore the disconnection of the old proxy
+	c.conn.setRestarting(true)
+	defer c.conn.setRestarting(false)
+
+	c.getProxy().Shutdown()
+	proxy, err := c.newProxy()
+	if err != nil {
+		c.lock.Lock()
+		rollback()
+		c.lock.Unlock()
+		if proxy, rerr := c.newProxy(); rerr == nil {
+			c.setProxy(proxy)
+		}
+		return err
+	}
+	c.setProxy(proxy)
+	return nil
+}
+
+func (c *Client) hasAccount(address string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	_, ok := c.accounts[normalizeAddress(address)]
+	return ok
+}
+
+func (c *Client) getRecvCh(address string) chan bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.recvCh[normalizeAddress(address)]
+}
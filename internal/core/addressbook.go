@@ -0,0 +1,229 @@
+// addressbook.go - persistent recipient keys
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+)
+
+const (
+	addressBookFile = "contacts.json"
+
+	// keyRefreshInterval is how often the key of a contact is fetched again
+	// to check that it didn't change
+	keyRefreshInterval = 24 * time.Hour
+)
+
+// KeyChangedError is returned when the key fetched for a contact doesn't
+// match the pinned one. The messages to the contact are not sent and its key
+// not fetched again until the application accepts the new key with
+// AddContact, or keeps the pinned one with Verify.
+type KeyChangedError struct {
+	Address   string
+	PinnedKey string
+	NewKey    string
+}
+
+func (e *KeyChangedError) Error() string {
+	return fmt.Sprintf("The key of %s changed from %s to %s", e.Address, e.PinnedKey, e.NewKey)
+}
+
+// Contact is a recipient known by the client, ChangedKey is set when a key
+// different from the pinned one was fetched
+type Contact struct {
+	Address     string
+	PublicKey   string
+	Verified    bool
+	LastFetched time.Time
+	ChangedKey  string `json:",omitempty"`
+}
+
+func (c *Contact) isStale() bool {
+	if c.Verified || c.ChangedKey != "" {
+		return false
+	}
+	return time.Since(c.LastFetched) > keyRefreshInterval
+}
+
+func (c *Contact) keyChanged() error {
+	if c.ChangedKey == "" {
+		return nil
+	}
+	return &KeyChangedError{c.Address, c.PublicKey, c.ChangedKey}
+}
+
+func (c *Contact) publicKey() (*ecdh.PublicKey, error) {
+	var key ecdh.PublicKey
+	if err := key.FromString(c.PublicKey); err != nil {
+		return nil, fmt.Errorf("Invalid key for %s: %v", c.Address, err)
+	}
+	return &key, nil
+}
+
+// AddressBook keeps the keys of the recipients in the data dir. Keys are
+// pinned the first time they are fetched.
+type AddressBook struct {
+	sync.Mutex
+	path     string
+	contacts map[string]*Contact
+}
+
+func openAddressBook(dataDir string) (*AddressBook, error) {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, err
+	}
+	a := &AddressBook{
+		path:     path.Join(dataDir, addressBookFile),
+		contacts: make(map[string]*Contact),
+	}
+
+	data, err := ioutil.ReadFile(a.path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &a.contacts); err != nil {
+		return nil, fmt.Errorf("Invalid address book %s: %v", a.path, err)
+	}
+	return a, nil
+}
+
+// Contacts returns the client address book
+func (c *Client) Contacts() *AddressBook {
+	return c.contacts
+}
+
+// Get returns a copy of the contact with address
+func (a *AddressBook) Get(address string) (*Contact, bool) {
+	a.Lock()
+	defer a.Unlock()
+	contact, ok := a.contacts[normalizeAddress(address)]
+	if !ok {
+		return nil, false
+	}
+	c := *contact
+	return &c, true
+}
+
+// List returns the addresses of all the contacts
+func (a *AddressBook) List() []string {
+	a.Lock()
+	defer a.Unlock()
+	addresses := make([]string, 0, len(a.contacts))
+	for address := range a.contacts {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// Add stores the key of a contact, replacing any previously pinned key.
+// Keys added by the application are considered verified.
+func (a *AddressBook) Add(address, publicKey string) error {
+	var key ecdh.PublicKey
+	if err := key.FromString(publicKey); err != nil {
+		return fmt.Errorf("Invalid key for %s: %v", address, err)
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	address = normalizeAddress(address)
+	a.contacts[address] = &Contact{
+		Address:     address,
+		PublicKey:   key.String(),
+		Verified:    true,
+		LastFetched: time.Now(),
+	}
+	return a.save()
+}
+
+// Verify marks the pinned key of a contact as verified by the user, it
+// will not be fetched again. A pending key change is discarded.
+func (a *AddressBook) Verify(address string) error {
+	a.Lock()
+	defer a.Unlock()
+	contact, ok := a.contacts[normalizeAddress(address)]
+	if !ok {
+		return fmt.Errorf("Unknown contact %s", address)
+	}
+	contact.Verified = true
+	contact.ChangedKey = ""
+	return a.save()
+}
+
+// Remove deletes a contact, its key will be pinned again on the next send
+func (a *AddressBook) Remove(address string) error {
+	a.Lock()
+	defer a.Unlock()
+	address = normalizeAddress(address)
+	if _, ok := a.contacts[address]; !ok {
+		return fmt.Errorf("Unknown contact %s", address)
+	}
+	delete(a.contacts, address)
+	return a.save()
+}
+
+// pin stores a fetched key on first use. If a different key was pinned it
+// records the change and returns a *KeyChangedError keeping the old one.
+func (a *AddressBook) pin(address string, key *ecdh.PublicKey) (*Contact, error) {
+	a.Lock()
+	defer a.Unlock()
+	address = normalizeAddress(address)
+	contact, ok := a.contacts[address]
+	if ok && contact.PublicKey != key.String() {
+		contact.ChangedKey = key.String()
+		if err := a.save(); err != nil {
+			return nil, err
+		}
+		return nil, contact.keyChanged()
+	}
+	if !ok {
+		contact = &Contact{
+			Address:   address,
+			PublicKey: key.String(),
+		}
+		a.contacts[address] = contact
+	}
+	contact.LastFetched = time.Now()
+
+	c := *contact
+	return &c, a.save()
+}
+
+// save has to be called holding the lock
+func (a *AddressBook) save() error {
+	data, err := json.MarshalIndent(a.contacts, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, a.path)
+}
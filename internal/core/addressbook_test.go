@@ -0,0 +1,256 @@
+// addressbook_test.go - persistent recipient keys tests
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+)
+
+// stubDiscovery returns key, or err if set, counting the lookups
+type stubDiscovery struct {
+	sync.Mutex
+	key     *ecdh.PublicKey
+	err     error
+	lookups int
+}
+
+func (d *stubDiscovery) Get(account, address string) (*ecdh.PublicKey, error) {
+	d.Lock()
+	defer d.Unlock()
+	d.lookups++
+	return d.key, d.err
+}
+
+func (d *stubDiscovery) set(key *ecdh.PublicKey, err error) {
+	d.Lock()
+	defer d.Unlock()
+	d.key = key
+	d.err = err
+}
+
+func (d *stubDiscovery) count() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.lookups
+}
+
+func genPublicKey(t *testing.T) *ecdh.PublicKey {
+	key, err := GenKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.PublicKey()
+}
+
+// waitEvent skips the events of other types
+func waitEvent(t *testing.T, c *Client, eventType EventType) *Event {
+	for {
+		ev, err := c.NextEvent(testTimeout)
+		if err != nil {
+			t.Fatalf("No %v event: %v", eventType, err)
+		}
+		if ev.Type == eventType {
+			return ev
+		}
+	}
+}
+
+func expireContact(c *Client, address string) {
+	c.contacts.Lock()
+	c.contacts.contacts[normalizeAddress(address)].LastFetched = time.Now().Add(-2 * keyRefreshInterval)
+	c.contacts.Unlock()
+}
+
+func TestAddressBookPin(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+	a, err := openAddressBook(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := genPublicKey(t)
+	second := genPublicKey(t)
+
+	contact, err := a.pin("Bob@Provider", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contact.Address != "bob@provider" || contact.PublicKey != first.String() || contact.Verified {
+		t.Errorf("Got contact %+v on first use", contact)
+	}
+	if contact.isStale() {
+		t.Error("A just fetched contact is stale")
+	}
+	if _, err := a.pin("bob@provider", first); err != nil {
+		t.Errorf("Pinning the same key failed: %v", err)
+	}
+
+	_, err = a.pin("bob@provider", second)
+	kerr, ok := err.(*KeyChangedError)
+	if !ok {
+		t.Fatalf("Got %v pinning a different key, expected a KeyChangedError", err)
+	}
+	if kerr.Address != "bob@provider" || kerr.PinnedKey != first.String() || kerr.NewKey != second.String() {
+		t.Errorf("Got %+v", kerr)
+	}
+
+	// the pin and the pending change survive a restart
+	a, err = openAddressBook(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contact, ok = a.Get("bob@provider")
+	if !ok {
+		t.Fatal("The contact was not saved")
+	}
+	if contact.PublicKey != first.String() || contact.ChangedKey != second.String() {
+		t.Errorf("Got contact %+v after the key change", contact)
+	}
+	if contact.keyChanged() == nil || contact.isStale() {
+		t.Error("A contact with a changed key has to be blocked and not refreshed")
+	}
+
+	if err := a.Verify("bob@provider"); err != nil {
+		t.Fatal(err)
+	}
+	contact, _ = a.Get("bob@provider")
+	if contact.PublicKey != first.String() || contact.ChangedKey != "" || !contact.Verified {
+		t.Errorf("Got contact %+v after verifying the pinned key", contact)
+	}
+
+	if err := a.Add("bob@provider", second.String()); err != nil {
+		t.Fatal(err)
+	}
+	contact, _ = a.Get("bob@provider")
+	if contact.PublicKey != second.String() || !contact.Verified {
+		t.Errorf("Got contact %+v after adding a new key", contact)
+	}
+	if err := a.Add("carol@provider", "not a key"); err == nil {
+		t.Error("An invalid key was added")
+	}
+
+	if err := a.Remove("bob@provider"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Remove("bob@provider"); err == nil {
+		t.Error("Removed an unknown contact")
+	}
+	if len(a.List()) != 0 {
+		t.Errorf("Got contacts %q after removing them", a.List())
+	}
+}
+
+func TestAddressBookStale(t *testing.T) {
+	tests := []struct {
+		contact Contact
+		stale   bool
+	}{
+		{Contact{LastFetched: time.Now()}, false},
+		{Contact{LastFetched: time.Now().Add(-2 * keyRefreshInterval)}, true},
+		{Contact{LastFetched: time.Now().Add(-2 * keyRefreshInterval), Verified: true}, false},
+		{Contact{LastFetched: time.Now().Add(-2 * keyRefreshInterval), ChangedKey: "key"}, false},
+	}
+	for _, test := range tests {
+		if test.contact.isStale() != test.stale {
+			t.Errorf("Got stale %v for %+v", !test.stale, test.contact)
+		}
+	}
+}
+
+func TestAddressBookKeyChangedEvent(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+	network := NewFakeNetwork(testLatency, 0)
+	alice := newFakeClient(t, network, dataDir, "alice")
+	defer alice.Shutdown()
+	bob := newFakeClient(t, network, dataDir, "bob")
+	defer bob.Shutdown()
+
+	discovery := &stubDiscovery{}
+	discovery.set(genPublicKey(t), nil)
+	alice.SetKeyDiscovery(discovery)
+	if _, err := alice.Send(bob.Address(), []byte(testPayload)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.Send(bob.Address(), []byte(testPayload)); err != nil {
+		t.Fatal(err)
+	}
+	if discovery.count() != 1 {
+		t.Errorf("The pinned key was fetched %d times, expected once", discovery.count())
+	}
+
+	newKey := genPublicKey(t)
+	discovery.set(newKey, nil)
+	expireContact(alice, bob.Address())
+	if _, err := alice.Send(bob.Address(), []byte(testPayload)); err == nil {
+		t.Fatal("Sent with a changed key")
+	}
+
+	ev := waitEvent(t, alice, EventKeyChanged)
+	if ev.Address != normalizeAddress(bob.Address()) {
+		t.Errorf("Got address %v, expected %v", ev.Address, bob.Address())
+	}
+	kerr, ok := ev.Err.(*KeyChangedError)
+	if !ok || kerr.NewKey != newKey.String() {
+		t.Errorf("Got error %v, expected a KeyChangedError to %v", ev.Err, newKey)
+	}
+}
+
+func TestAddressBookRefreshFailure(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+	network := NewFakeNetwork(testLatency, 0)
+	alice := newFakeClient(t, network, dataDir, "alice")
+	defer alice.Shutdown()
+	bob := newFakeClient(t, network, dataDir, "bob")
+	defer bob.Shutdown()
+
+	discovery := &stubDiscovery{}
+	discovery.set(nil, errors.New("Discovery is down"))
+	alice.SetKeyDiscovery(discovery)
+	if _, err := alice.Send(bob.Address(), []byte(testPayload)); err == nil {
+		t.Fatal("Sent without a key")
+	}
+
+	// the real key is pinned and then the refresh fails
+	alice.SetKeyDiscovery(nil)
+	if _, err := alice.Send(bob.Address(), []byte(testPayload)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.GetMessage(testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	alice.SetKeyDiscovery(discovery)
+	expireContact(alice, bob.Address())
+	if _, err := alice.Send(bob.Address(), []byte(testPayload)); err != nil {
+		t.Fatalf("The pinned key was not used: %v", err)
+	}
+	if _, err := bob.GetMessage(testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	ev := waitEvent(t, alice, EventError)
+	if ev.Address != bob.Address() || ev.AccountID != alice.Address() || ev.Err == nil {
+		t.Errorf("Got event %+v, expected a refresh error for %v", ev, bob.Address())
+	}
+}
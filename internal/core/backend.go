@@ -0,0 +1,50 @@
+// backend.go - mixnet backend of the client
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/mailproxy"
+)
+
+// backend is the part of the mailproxy used by the client, implemented as
+// well by FakeNetwork. Events are written to the client eventSink.
+type backend interface {
+	Shutdown()
+	ListProviders(authorityID string) ([]*pki.MixDescriptor, error)
+	SetRecipient(recipientID string, publicKey *ecdh.PublicKey) error
+	SendMessage(senderID, recipientID string, payload []byte) ([]byte, error)
+	SendKaetzchenRequest(senderID, recipient, provider string, payload []byte, wantResponse bool) ([]byte, error)
+	ReceivePeek(accountID string) (*mailproxy.Message, error)
+	ReceivePop(accountID string) (*mailproxy.Message, error)
+}
+
+var _ backend = (*mailproxy.Proxy)(nil)
+
+// messageAckedEvent is emitted by the backends that know when the recipient's
+// provider acknowledged a message, after its MessageSentEvent
+type messageAckedEvent struct {
+	AccountID string
+	MessageID []byte
+}
+
+func (e *messageAckedEvent) String() string {
+	return fmt.Sprintf("MessageAcked: %v %x", e.AccountID, e.MessageID)
+}
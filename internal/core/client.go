@@ -0,0 +1,490 @@
+// client.go - mixnet client
+// Copyright (C) 2017  Yawning Angel.
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package core implements the mixnet client shared by all the language
+// bindings. The python and java packages are thin facades over it.
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/mailproxy"
+	"github.com/katzenpost/mailproxy/config"
+	"github.com/katzenpost/mailproxy/event"
+)
+
+const (
+	pkiName = "default"
+)
+
+var (
+	// ErrTimeout is returned on timeouts
+	ErrTimeout = errors.New("Timeout")
+
+	// ErrShutdown is returned when the client was shut down while waiting
+	ErrShutdown = errors.New("Client is shut down")
+)
+
+// Client is katzenpost object
+type Client struct {
+	cfg       *Config
+	address   string
+	eventSink chan event.Event
+	haltCh    chan struct{}
+	haltOnce  sync.Once
+	conn      *connection
+	events    *eventQueue
+	status    *statusTracker
+	contacts  *AddressBook
+	inbox     *inbox
+	store     *MessageStore
+	replies   *replyTracker
+	documents documentCache
+
+	lock      sync.RWMutex
+	proxy     backend
+	listeners bool
+	accounts  map[string]*Account
+	recvCh    map[string]chan bool
+	discovery KeyDiscovery
+
+	// restartLock serializes the proxy restarts, lock is only taken to
+	// swap the proxy as it emits events while starting and shutting down
+	restartLock sync.Mutex
+
+	// spoolLock serializes the moves from the spool to the inbox
+	spoolLock sync.Mutex
+
+	handlerLock sync.RWMutex
+	handler     Handler
+	deliverLock sync.Mutex
+}
+
+// New creates a katzenpost client
+func New(cfg *Config) (*Client, error) {
+	if err := cfg.UpstreamProxy.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateListeners(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateAuthorities(); err != nil {
+		return nil, err
+	}
+
+	account := cfg.getAccount()
+	address := account.Address()
+	c := &Client{
+		cfg:       cfg,
+		address:   address,
+		eventSink: make(chan event.Event),
+		haltCh:    make(chan struct{}),
+		conn:      newConnection(cfg.getBackoff()),
+		events:    newEventQueue(),
+		status:    newStatusTracker(),
+		replies:   newReplyTracker(),
+		accounts:  map[string]*Account{address: account},
+		listeners: cfg.LaunchListeners,
+		recvCh:    map[string]chan bool{address: make(chan bool, 1)},
+	}
+	for _, account := range cfg.Accounts {
+		address := account.Address()
+		if _, ok := c.accounts[address]; ok {
+			return nil, ErrAccountExists
+		}
+		c.accounts[address] = account
+		c.recvCh[address] = make(chan bool, 1)
+	}
+
+	dataDir, err := cfg.getDataDir()
+	if err != nil {
+		return nil, err
+	}
+	c.contacts, err = openAddressBook(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	var box sealer
+	if cfg.StorePassphrase != "" {
+		c.store, err = openMessageStore(dataDir, cfg.StorePassphrase)
+		if err != nil {
+			return nil, err
+		}
+		box = c.store
+	}
+	c.inbox, err = openInbox(dataDir, box)
+	if err != nil {
+		return nil, err
+	}
+	c.discovery, err = c.defaultKeyDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	c.proxy, err = c.newProxy()
+	if err != nil {
+		return nil, err
+	}
+	go c.eventHandler()
+
+	// pick up the messages received before a crash or restart
+	for _, account := range c.Accounts() {
+		if err := c.fetchSpool(account); err != nil {
+			c.Shutdown()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// newProxy builds a proxy for the current account list, it can't be called
+// holding the lock
+func (c *Client) newProxy() (backend, error) {
+	c.lock.RLock()
+	accounts := make([]*Account, 0, len(c.accounts))
+	for _, account := range c.accounts {
+		accounts = append(accounts, account)
+	}
+	listeners := c.listeners
+	c.lock.RUnlock()
+
+	if c.cfg.FakeNetwork != nil {
+		return c.cfg.FakeNetwork.attach(c, accounts)
+	}
+
+	dataDir, err := c.cfg.getDataDir()
+	if err != nil {
+		return nil, err
+	}
+
+	proxyAccounts := make([]*config.Account, len(accounts))
+	for i, account := range accounts {
+		proxyAccounts[i], err = account.toProxy()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	proxyCfg := config.Config{
+		Proxy: &config.Proxy{
+			NoLaunchListeners: !listeners,
+			SMTPAddress:       c.cfg.getSMTPAddress(),
+			POP3Address:       c.cfg.getPOP3Address(),
+			DataDir:           dataDir,
+			EventSink:         c.eventSink,
+		},
+		Logging:       c.cfg.getLogging(),
+		UpstreamProxy: c.cfg.getUpstreamProxy(),
+		Account:       proxyAccounts,
+		Recipients:    map[string]*ecdh.PublicKey{},
+	}
+	err = c.cfg.setAuthority(&proxyCfg)
+	if err != nil {
+		return nil, err
+	}
+	err = proxyCfg.FixupAndValidate()
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := mailproxy.New(&proxyCfg)
+	if err != nil {
+		return nil, err
+	}
+	return proxy, nil
+}
+
+func (c *Client) getProxy() backend {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.proxy
+}
+
+func (c *Client) setProxy(proxy backend) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.proxy = proxy
+}
+
+// Address returns the address of the default account
+func (c *Client) Address() string {
+	return c.address
+}
+
+// ListProviders returns the provider list
+func (c *Client) ListProviders() ([]string, error) {
+	providers, err := c.getProxy().ListProviders(pkiName)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(providers))
+	for i, provider := range providers {
+		names[i] = provider.Name
+	}
+	return names, nil
+}
+
+// Shutdown the client, it can be called more than once
+func (c *Client) Shutdown() {
+	c.haltOnce.Do(func() {
+		c.conn.Lock()
+		c.conn.stopTimer()
+		c.conn.Unlock()
+		c.setState(StateShutdown, nil)
+
+		// wait for any restart in progress, none starts after the state
+		// is StateShutdown
+		c.restartLock.Lock()
+		c.getProxy().Shutdown()
+		c.restartLock.Unlock()
+		close(c.haltCh)
+	})
+}
+
+// Send a message into katzenpost from the default account, it returns the
+// message ID that can be used to track its delivery
+func (c *Client) Send(recipient string, msg []byte) ([]byte, error) {
+	return c.SendFrom(c.address, recipient, msg)
+}
+
+// SendFrom sends a message into katzenpost from the given account
+func (c *Client) SendFrom(account, recipient string, msg []byte) ([]byte, error) {
+	if !c.hasAccount(account) {
+		return nil, ErrUnknownAccount
+	}
+	err := c.setRecipientKey(account, recipient)
+	if err != nil {
+		return nil, err
+	}
+	messageID, err := c.getProxy().SendMessage(account, recipient, msg)
+	if err != nil {
+		return nil, err
+	}
+	c.status.queued(messageID)
+	c.archiveSent(account, recipient, messageID, msg)
+	return messageID, nil
+}
+
+// setRecipientKey looks for the recipient key in the address book, fetching
+// and pinning it on first use or when the cached one is too old. The key is
+// discovered from account, the one sending the message. If the refresh of a
+// pinned key fails the pinned one is used and the error reported as an event.
+func (c *Client) setRecipientKey(account, address string) error {
+	contact, pinned := c.contacts.Get(address)
+	if pinned {
+		if err := contact.keyChanged(); err != nil {
+			return err
+		}
+	}
+
+	if !pinned || contact.isStale() {
+		key, err := c.KeyDiscovery().Get(account, address)
+		switch {
+		case err != nil && !pinned:
+			return err
+		case err != nil:
+			c.events.push(&Event{
+				Type:      EventError,
+				AccountID: account,
+				Address:   address,
+				Err:       fmt.Errorf("Can't refresh the key of %s, using the pinned one: %v", address, err),
+			})
+		default:
+			contact, err = c.contacts.pin(address, key)
+			if kerr, ok := err.(*KeyChangedError); ok {
+				c.events.push(&Event{Type: EventKeyChanged, Address: kerr.Address, Err: kerr})
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	key, err := contact.publicKey()
+	if err != nil {
+		return err
+	}
+	return c.getProxy().SetRecipient(address, key)
+}
+
+// Message received from katzenpost, ID identifies it in the inbox
+type Message struct {
+	ID        string
+	Account   string
+	Sender    string
+	SenderKey *ecdh.PublicKey
+	Received  time.Time
+	Payload   []byte
+}
+
+// GetMessage from katzenpost for the default account, a timeout of 0 blocks
+// until a message arrives
+func (c *Client) GetMessage(timeout time.Duration) (*Message, error) {
+	return c.GetMessageFor(c.address, timeout)
+}
+
+// GetMessageFor returns the oldest message in the inbox of account removing
+// it, waiting for one to arrive up to timeout
+func (c *Client) GetMessageFor(account string, timeout time.Duration) (*Message, error) {
+	account = normalizeAddress(account)
+	return c.waitInbox(account, timeout, nil, func() (*Message, error) {
+		return c.inbox.pop(account)
+	})
+}
+
+// WaitMessageFor returns the oldest message in the inbox of account without
+// removing it, waiting for one to arrive up to timeout or until cancel is
+// closed. The messages skip returns true for are ignored. The message is
+// marked as read, DeleteMessage removes it once processed.
+func (c *Client) WaitMessageFor(account string, timeout time.Duration, cancel <-chan struct{}, skip func(id string) bool) (*Message, error) {
+	account = normalizeAddress(account)
+	return c.waitInbox(account, timeout, cancel, func() (*Message, error) {
+		for _, entry := range c.inbox.list(account) {
+			if skip != nil && skip(entry.ID) {
+				continue
+			}
+			msg, err := c.inbox.peek(account, entry.ID)
+			if err == ErrNotInInbox {
+				continue
+			}
+			return msg, err
+		}
+		return nil, nil
+	})
+}
+
+// waitInbox calls get until it returns a message or an error, retrying each
+// time a message arrives to the inbox of account
+func (c *Client) waitInbox(account string, timeout time.Duration, cancel <-chan struct{}, get func() (*Message, error)) (*Message, error) {
+	recvCh := c.getRecvCh(account)
+	if recvCh == nil {
+		return nil, ErrUnknownAccount
+	}
+
+	var timeoutCh <-chan time.Time
+	if timeout != 0 {
+		timeoutCh = time.After(timeout)
+	}
+
+	for {
+		msg, err := get()
+		if msg != nil {
+			// pass the notification on, other callers might be waiting for
+			// the rest of the messages
+			select {
+			case recvCh <- true:
+			default:
+			}
+		}
+		if msg != nil || err != nil {
+			return msg, err
+		}
+
+		select {
+		case <-recvCh:
+		case <-timeoutCh:
+			return nil, ErrTimeout
+		case <-cancel:
+			return nil, ErrShutdown
+		case <-c.haltCh:
+			return nil, ErrShutdown
+		}
+	}
+}
+
+// received moves the messages from the spool to the inbox and notifies
+// them to the handler or to GetMessage
+func (c *Client) received(account string) {
+	if err := c.fetchSpool(account); err != nil {
+		c.events.push(&Event{Type: EventError, AccountID: account, Err: err})
+	}
+
+	if c.getHandler() == nil {
+		if recvCh := c.getRecvCh(account); recvCh != nil {
+			select {
+			case recvCh <- true:
+			default:
+			}
+		}
+		return
+	}
+	c.deliverInbox(account)
+}
+
+// deliverInbox passes the messages in the inbox of account to the handler,
+// removing them from the inbox
+func (c *Client) deliverInbox(account string) {
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+	handler := c.getHandler()
+	if handler == nil {
+		return
+	}
+
+	for _, entry := range c.inbox.list(account) {
+		msg, err := c.inbox.peek(account, entry.ID)
+		if err != nil {
+			c.events.push(&Event{Type: EventError, AccountID: account, Err: err})
+			continue
+		}
+		handler.ReceivedMessage(msg)
+		c.inbox.delete(account, entry.ID)
+	}
+}
+
+func (c *Client) eventHandler() {
+	for {
+		var ev event.Event
+		select {
+		case ev = <-c.eventSink:
+		case <-c.haltCh:
+			return
+		}
+
+		if e := newEvent(ev); e != nil {
+			c.events.push(e)
+		}
+
+		handler := c.getHandler()
+		switch ev := ev.(type) {
+		case *event.MessageReceivedEvent:
+			c.received(normalizeAddress(ev.AccountID))
+		case *event.KaetzchenReplyEvent:
+			c.replies.deliver(ev)
+		case *event.MessageSentEvent:
+			c.status.sent(ev.MessageID, ev.Err)
+			if handler != nil {
+				handler.ReceivedACK(ev.MessageID, ev.Err)
+			}
+		case *messageAckedEvent:
+			c.status.acked(ev.MessageID)
+		case *event.ConnectionStatusEvent:
+			if normalizeAddress(ev.AccountID) == c.address {
+				c.connectionChanged(ev.IsConnected, ev.Err)
+			}
+			if handler != nil {
+				handler.ConnectionChanged(ev.IsConnected, ev.Err)
+			}
+		default:
+			continue
+		}
+	}
+}
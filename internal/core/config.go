@@ -0,0 +1,270 @@
+// config.go - mixnet client configuration
+// Copyright (C) 2017  Yawning Angel.
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	vConfig "github.com/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/mailproxy/config"
+)
+
+// Config has the client configuration
+type Config struct {
+	// PkiAddress and PkiKey configure a nonvoting authority, they are
+	// ignored if Authorities is not empty.
+	PkiAddress string
+	PkiKey     string
+
+	// Authorities is the set of voting directory authorities.
+	Authorities []*Authority
+
+	// Threshold is the number of Authorities that have to sign a consensus
+	// document, between a majority, the default, and len(Authorities). The
+	// mailproxy voting client always requires a majority, so a lower one
+	// is rejected. A higher one is checked on top of it on the documents
+	// read by the client, like the NetworkInfo ones. It's not saved in the
+	// configuration file, mailproxy has no such setting.
+	Threshold int
+
+	User        string
+	Provider    string
+	IdentityKey *ecdh.PrivateKey
+	LinkKey     *ecdh.PrivateKey
+
+	// ProviderKeyPin, StorageKey and InsecureKeyDiscovery configure the
+	// default account as described in Account.
+	ProviderKeyPin       string
+	StorageKey           *ecdh.PrivateKey
+	InsecureKeyDiscovery bool
+
+	// Accounts are hosted by the client besides the default one above.
+	Accounts []*Account
+
+	// KeyDiscovery selects how the recipient keys are fetched, one of
+	// the KeyDiscovery constants. It defaults to KeyDiscoveryMixnet.
+	KeyDiscovery string
+
+	// KeyDiscoveryPort is the port of the HTTP key endpoint of the
+	// providers, it defaults to 7900. It's not saved in the configuration
+	// file.
+	KeyDiscoveryPort int
+
+	// StorePassphrase enables the encrypted message store in the data dir
+	// archiving the sent and received messages, the inbox gets encrypted
+	// with it as well. The mailproxy spool is only encrypted if the account
+	// has a StorageKey. It's not saved in the configuration file.
+	StorePassphrase string
+
+	// Backoff configures the reconnections, the zero fields use the
+	// defaults: 5 seconds initial delay doubling up to 5 minutes.
+	Backoff *Backoff
+
+	// SMTPAddress and POP3Address are the loopback addresses where the
+	// mailproxy listeners for mail clients are launched, if LaunchListeners
+	// is set or by StartListeners.
+	SMTPAddress     string
+	POP3Address     string
+	LaunchListeners bool
+
+	// FakeNetwork replaces the mixnet by an in-memory one for tests, the
+	// authority configuration is ignored when set.
+	FakeNetwork *FakeNetwork
+
+	Log           *LogConfig
+	UpstreamProxy *UpstreamProxy
+	DataDir       string
+}
+
+// LogConfig keeps the configuration of the loger
+type LogConfig struct {
+	File    string
+	Level   string
+	Enabled bool
+}
+
+// UpstreamProxy is the proxy used to reach the network, it's used for the
+// provider and authority connections and the HTTP key fetches. Type is one
+// of the Proxy constants, Network defaults to tcp.
+type UpstreamProxy struct {
+	Type     string
+	Network  string
+	Address  string
+	User     string
+	Password string
+}
+
+// Authority is a voting directory authority
+type Authority struct {
+	IdentityKey string
+	LinkKey     string
+	Addresses   []string
+}
+
+func (a *Authority) toPeer() (*vConfig.AuthorityPeer, error) {
+	if len(a.Addresses) == 0 {
+		return nil, errors.New("Authority without addresses")
+	}
+
+	var identityKey eddsa.PublicKey
+	if err := identityKey.FromString(a.IdentityKey); err != nil {
+		return nil, fmt.Errorf("Invalid authority IdentityKey %v: %v", a.IdentityKey, err)
+	}
+	var linkKey ecdh.PublicKey
+	if err := linkKey.FromString(a.LinkKey); err != nil {
+		return nil, fmt.Errorf("Invalid authority LinkKey %v: %v", a.LinkKey, err)
+	}
+	return &vConfig.AuthorityPeer{
+		IdentityPublicKey: &identityKey,
+		LinkPublicKey:     &linkKey,
+		Addresses:         a.Addresses,
+	}, nil
+}
+
+func (c *Config) validateAuthorities() error {
+	if c.Threshold == 0 {
+		return nil
+	}
+	if len(c.Authorities) == 0 {
+		return errors.New("Threshold is only used with voting Authorities")
+	}
+	majority := len(c.Authorities)/2 + 1
+	if c.Threshold < majority || c.Threshold > len(c.Authorities) {
+		return fmt.Errorf("Invalid Threshold %d, it has to be between a majority, %d, and %d", c.Threshold, majority, len(c.Authorities))
+	}
+	return nil
+}
+
+func (c *Config) getThreshold() int {
+	if c.Threshold == 0 {
+		return len(c.Authorities)/2 + 1
+	}
+	return c.Threshold
+}
+
+// verifyThreshold checks that a consensus document is signed by Threshold of
+// the Authorities
+func (c *Config) verifyThreshold(rawDoc []byte) error {
+	if len(c.Authorities) == 0 || c.FakeNetwork != nil {
+		return nil
+	}
+
+	verifiers := make([]cert.Verifier, len(c.Authorities))
+	for i, authority := range c.Authorities {
+		var identityKey eddsa.PublicKey
+		if err := identityKey.FromString(authority.IdentityKey); err != nil {
+			return fmt.Errorf("Invalid authority IdentityKey %v: %v", authority.IdentityKey, err)
+		}
+		verifiers[i] = &identityKey
+	}
+	_, good, _, err := cert.VerifyThreshold(verifiers, c.getThreshold(), rawDoc)
+	if err != nil {
+		return fmt.Errorf("The consensus document is signed by %d authorities, %d are required: %v", len(good), c.getThreshold(), err)
+	}
+	return nil
+}
+
+func (c *Config) setAuthority(proxyCfg *config.Config) error {
+	if len(c.Authorities) == 0 {
+		var pkiPublicKey eddsa.PublicKey
+		if err := pkiPublicKey.FromString(c.PkiKey); err != nil {
+			return fmt.Errorf("Invalid PkiKey: %v", err)
+		}
+		proxyCfg.NonvotingAuthority = map[string]*config.NonvotingAuthority{
+			pkiName: &config.NonvotingAuthority{
+				Address:   c.PkiAddress,
+				PublicKey: &pkiPublicKey,
+			},
+		}
+		return nil
+	}
+
+	peers := make([]*vConfig.AuthorityPeer, len(c.Authorities))
+	for i, authority := range c.Authorities {
+		peer, err := authority.toPeer()
+		if err != nil {
+			return err
+		}
+		peers[i] = peer
+	}
+	proxyCfg.VotingAuthority = map[string]*config.VotingAuthority{
+		pkiName: &config.VotingAuthority{Peers: peers},
+	}
+	return nil
+}
+
+func (c *Config) getAccount() *Account {
+	return &Account{
+		User:                 c.User,
+		Provider:             c.Provider,
+		IdentityKey:          c.IdentityKey,
+		LinkKey:              c.LinkKey,
+		ProviderKeyPin:       c.ProviderKeyPin,
+		StorageKey:           c.StorageKey,
+		InsecureKeyDiscovery: c.InsecureKeyDiscovery,
+	}
+}
+
+func (c *Config) getUpstreamProxy() *config.UpstreamProxy {
+	if c.UpstreamProxy.getType() == ProxyNone {
+		return &config.UpstreamProxy{
+			Type: ProxyNone,
+		}
+	}
+	return &config.UpstreamProxy{
+		Type:     c.UpstreamProxy.Type,
+		Network:  c.UpstreamProxy.getNetwork(),
+		Address:  c.UpstreamProxy.Address,
+		User:     c.UpstreamProxy.User,
+		Password: c.UpstreamProxy.Password,
+	}
+}
+
+func (c *Config) getDataDir() (string, error) {
+	return resolveDataDir(c.DataDir)
+}
+
+// resolveDataDir defaults to the data folder in the working directory
+func resolveDataDir(dataDir string) (string, error) {
+	if dataDir != "" {
+		return dataDir, nil
+	}
+
+	workingDir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(workingDir, "data"), nil
+}
+
+func (c *Config) getLogging() *config.Logging {
+	if c.Log != nil && c.Log.Level != "" {
+		return &config.Logging{
+			File:    c.Log.File,
+			Level:   c.Log.Level,
+			Disable: !c.Log.Enabled,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+// config_test.go - client configuration tests
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"testing"
+)
+
+func TestValidateThreshold(t *testing.T) {
+	tests := []struct {
+		authorities int
+		threshold   int
+		valid       bool
+	}{
+		{0, 0, true},
+		{0, 1, false},
+		{3, 0, true},
+		{3, 1, false},
+		{3, 2, true},
+		{3, 3, true},
+		{3, 4, false},
+		{4, 2, false},
+		{4, 3, true},
+		{5, 2, false},
+		{5, 3, true},
+	}
+	for _, test := range tests {
+		cfg := &Config{Threshold: test.threshold}
+		for i := 0; i < test.authorities; i++ {
+			cfg.Authorities = append(cfg.Authorities, &Authority{})
+		}
+		err := cfg.validateAuthorities()
+		if test.valid && err != nil {
+			t.Errorf("Threshold %d of %d rejected: %v", test.threshold, test.authorities, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Threshold %d of %d accepted", test.threshold, test.authorities)
+		}
+	}
+}
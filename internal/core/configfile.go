@@ -0,0 +1,404 @@
+// configfile.go - mailproxy compatible configuration files
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/BurntSushi/toml"
+	"github.com/katzenpost/core/crypto/ecdh"
+)
+
+// publicKeySize is the size of the eddsa and ecdh public keys
+const publicKeySize = 32
+
+// The file structs mirror the TOML layout of github.com/katzenpost/mailproxy/config,
+// keys are base64 encoded as mailproxy does.
+
+type fileConfig struct {
+	Proxy              *fileProxy
+	Logging            *fileLogging
+	Management         map[string]interface{} `toml:",omitempty"`
+	UpstreamProxy      *fileUpstreamProxy
+	Debug              map[string]interface{}             `toml:",omitempty"`
+	NonvotingAuthority map[string]*fileNonvotingAuthority `toml:",omitempty"`
+	VotingAuthority    map[string]*fileVotingAuthority    `toml:",omitempty"`
+	Account            []*fileAccount
+	Recipients         map[string]string `toml:",omitempty"`
+}
+
+type fileProxy struct {
+	POP3Address       string `toml:",omitempty"`
+	SMTPAddress       string `toml:",omitempty"`
+	DataDir           string
+	NoLaunchListeners bool `toml:",omitempty"`
+}
+
+type fileLogging struct {
+	Disable bool
+	File    string
+	Level   string
+}
+
+type fileUpstreamProxy struct {
+	Type     string
+	Network  string `toml:",omitempty"`
+	Address  string `toml:",omitempty"`
+	User     string `toml:",omitempty"`
+	Password string `toml:",omitempty"`
+}
+
+type fileNonvotingAuthority struct {
+	Address   string
+	PublicKey string
+}
+
+type fileVotingAuthority struct {
+	Peers []*fileAuthorityPeer
+}
+
+type fileAuthorityPeer struct {
+	IdentityPublicKey string
+	LinkPublicKey     string
+	Addresses         []string
+}
+
+type fileAccount struct {
+	User                 string
+	Provider             string
+	ProviderKeyPin       string `toml:",omitempty"`
+	Authority            string
+	LinkKey              string `toml:",omitempty"`
+	IdentityKey          string `toml:",omitempty"`
+	StorageKey           string `toml:",omitempty"`
+	InsecureKeyDiscovery bool   `toml:",omitempty"`
+}
+
+// LoadConfig reads a mailproxy TOML configuration file. The bindings only
+// support a single authority, voting or nonvoting, and the first account
+// becomes the default one. Accounts without keys use the ones the mailproxy
+// keeps in the data dir. The Management, Debug and Recipients sections are
+// not supported, the bindings manage the recipient keys in the address book.
+func LoadConfig(path string) (*Config, error) {
+	var f fileConfig
+	md, err := toml.DecodeFile(path, &f)
+	if err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) != 0 {
+		return nil, fmt.Errorf("config: Undecoded keys in config file: %v", undecoded)
+	}
+
+	if err := f.checkUnsupported(); err != nil {
+		return nil, err
+	}
+
+	cfg := new(Config)
+	if f.Proxy == nil || f.Proxy.DataDir == "" {
+		return nil, fmt.Errorf("config: Proxy: DataDir is not set")
+	}
+	cfg.DataDir = f.Proxy.DataDir
+	cfg.SMTPAddress = f.Proxy.SMTPAddress
+	cfg.POP3Address = f.Proxy.POP3Address
+	cfg.LaunchListeners = !f.Proxy.NoLaunchListeners
+
+	if f.Logging != nil {
+		cfg.Log = &LogConfig{
+			File:    f.Logging.File,
+			Level:   f.Logging.Level,
+			Enabled: !f.Logging.Disable,
+		}
+	}
+	if f.UpstreamProxy != nil {
+		cfg.UpstreamProxy = &UpstreamProxy{
+			Type:     f.UpstreamProxy.Type,
+			Network:  f.UpstreamProxy.Network,
+			Address:  f.UpstreamProxy.Address,
+			User:     f.UpstreamProxy.User,
+			Password: f.UpstreamProxy.Password,
+		}
+	}
+
+	authorityName, err := f.loadAuthority(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Account) == 0 {
+		return nil, fmt.Errorf("config: No Account configured")
+	}
+	for i, a := range f.Account {
+		account, err := a.toAccount(authorityName)
+		if err != nil {
+			return nil, fmt.Errorf("config: Account[%d]: %v", i, err)
+		}
+		if i == 0 {
+			cfg.User = account.User
+			cfg.Provider = account.Provider
+			cfg.IdentityKey = account.IdentityKey
+			cfg.LinkKey = account.LinkKey
+			cfg.ProviderKeyPin = account.ProviderKeyPin
+			cfg.StorageKey = account.StorageKey
+			cfg.InsecureKeyDiscovery = account.InsecureKeyDiscovery
+		} else {
+			cfg.Accounts = append(cfg.Accounts, account)
+		}
+	}
+	return cfg, nil
+}
+
+func (f *fileConfig) checkUnsupported() error {
+	switch {
+	case len(f.Management) != 0:
+		return fmt.Errorf("config: Management is not supported by the bindings")
+	case len(f.Debug) != 0:
+		return fmt.Errorf("config: Debug is not supported by the bindings")
+	case len(f.Recipients) != 0:
+		return fmt.Errorf("config: Recipients is not supported by the bindings, use the address book")
+	}
+	return nil
+}
+
+func (f *fileConfig) loadAuthority(cfg *Config) (string, error) {
+	if len(f.NonvotingAuthority)+len(f.VotingAuthority) != 1 {
+		return "", fmt.Errorf("config: Exactly one NonvotingAuthority or VotingAuthority is required")
+	}
+
+	for name, a := range f.NonvotingAuthority {
+		if a.Address == "" {
+			return "", fmt.Errorf("config: NonvotingAuthority %v: Address is not set", name)
+		}
+		key, err := publicKeyToHex(a.PublicKey)
+		if err != nil {
+			return "", fmt.Errorf("config: NonvotingAuthority %v: Invalid PublicKey: %v", name, err)
+		}
+		cfg.PkiAddress = a.Address
+		cfg.PkiKey = key
+		return name, nil
+	}
+
+	for name, a := range f.VotingAuthority {
+		if len(a.Peers) == 0 {
+			return "", fmt.Errorf("config: VotingAuthority %v: No Peers configured", name)
+		}
+		for i, peer := range a.Peers {
+			identityKey, err := publicKeyToHex(peer.IdentityPublicKey)
+			if err != nil {
+				return "", fmt.Errorf("config: VotingAuthority %v: Peers[%d]: Invalid IdentityPublicKey: %v", name, i, err)
+			}
+			linkKey, err := publicKeyToHex(peer.LinkPublicKey)
+			if err != nil {
+				return "", fmt.Errorf("config: VotingAuthority %v: Peers[%d]: Invalid LinkPublicKey: %v", name, i, err)
+			}
+			if len(peer.Addresses) == 0 {
+				return "", fmt.Errorf("config: VotingAuthority %v: Peers[%d]: No Addresses configured", name, i)
+			}
+			cfg.Authorities = append(cfg.Authorities, &Authority{
+				IdentityKey: identityKey,
+				LinkKey:     linkKey,
+				Addresses:   peer.Addresses,
+			})
+		}
+		return name, nil
+	}
+	return "", nil
+}
+
+func (a *fileAccount) toAccount(authorityName string) (*Account, error) {
+	if a.User == "" {
+		return nil, fmt.Errorf("User is not set")
+	}
+	if a.Provider == "" {
+		return nil, fmt.Errorf("Provider is not set")
+	}
+	if a.Authority != authorityName {
+		return nil, fmt.Errorf("Authority %v is not configured", a.Authority)
+	}
+
+	account := &Account{
+		User:                 a.User,
+		Provider:             a.Provider,
+		InsecureKeyDiscovery: a.InsecureKeyDiscovery,
+	}
+	var err error
+	if a.ProviderKeyPin != "" {
+		account.ProviderKeyPin, err = publicKeyToHex(a.ProviderKeyPin)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ProviderKeyPin: %v", err)
+		}
+	}
+	if a.StorageKey != "" {
+		account.StorageKey, err = Base64ToKey(a.StorageKey)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid StorageKey: %v", err)
+		}
+	}
+	if a.LinkKey != "" {
+		account.LinkKey, err = Base64ToKey(a.LinkKey)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid LinkKey: %v", err)
+		}
+	}
+	if a.IdentityKey != "" {
+		account.IdentityKey, err = Base64ToKey(a.IdentityKey)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid IdentityKey: %v", err)
+		}
+	}
+	return account, nil
+}
+
+// Save writes the configuration as a mailproxy TOML configuration file,
+// private keys are written in the file so it should be kept private.
+func (c *Config) Save(path string) error {
+	dataDir, err := c.getDataDir()
+	if err != nil {
+		return err
+	}
+
+	f := fileConfig{
+		Proxy: &fileProxy{
+			POP3Address:       c.POP3Address,
+			SMTPAddress:       c.SMTPAddress,
+			DataDir:           dataDir,
+			NoLaunchListeners: !c.LaunchListeners,
+		},
+	}
+	if logging := c.getLogging(); logging != nil {
+		f.Logging = &fileLogging{
+			Disable: logging.Disable,
+			File:    logging.File,
+			Level:   logging.Level,
+		}
+	}
+	upstream := c.getUpstreamProxy()
+	f.UpstreamProxy = &fileUpstreamProxy{
+		Type:     upstream.Type,
+		Network:  upstream.Network,
+		Address:  upstream.Address,
+		User:     upstream.User,
+		Password: upstream.Password,
+	}
+
+	if len(c.Authorities) == 0 {
+		key, err := toBase64(c.PkiKey)
+		if err != nil {
+			return fmt.Errorf("Invalid PkiKey: %v", err)
+		}
+		f.NonvotingAuthority = map[string]*fileNonvotingAuthority{
+			pkiName: &fileNonvotingAuthority{
+				Address:   c.PkiAddress,
+				PublicKey: key,
+			},
+		}
+	} else {
+		peers := make([]*fileAuthorityPeer, len(c.Authorities))
+		for i, a := range c.Authorities {
+			identityKey, err := toBase64(a.IdentityKey)
+			if err != nil {
+				return fmt.Errorf("Invalid authority IdentityKey %v: %v", a.IdentityKey, err)
+			}
+			linkKey, err := toBase64(a.LinkKey)
+			if err != nil {
+				return fmt.Errorf("Invalid authority LinkKey %v: %v", a.LinkKey, err)
+			}
+			peers[i] = &fileAuthorityPeer{
+				IdentityPublicKey: identityKey,
+				LinkPublicKey:     linkKey,
+				Addresses:         a.Addresses,
+			}
+		}
+		f.VotingAuthority = map[string]*fileVotingAuthority{
+			pkiName: &fileVotingAuthority{Peers: peers},
+		}
+	}
+
+	accounts := append([]*Account{c.getAccount()}, c.Accounts...)
+	for _, a := range accounts {
+		account := &fileAccount{
+			User:                 a.User,
+			Provider:             a.Provider,
+			Authority:            pkiName,
+			LinkKey:              privateToBase64(a.LinkKey),
+			IdentityKey:          privateToBase64(a.IdentityKey),
+			StorageKey:           privateToBase64(a.StorageKey),
+			InsecureKeyDiscovery: a.InsecureKeyDiscovery,
+		}
+		if a.ProviderKeyPin != "" {
+			account.ProviderKeyPin, err = toBase64(a.ProviderKeyPin)
+			if err != nil {
+				return fmt.Errorf("Invalid ProviderKeyPin %v: %v", a.ProviderKeyPin, err)
+			}
+		}
+		f.Account = append(f.Account, account)
+	}
+
+	tmpPath := path + ".tmp"
+	out, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := toml.NewEncoder(out).Encode(&f); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// publicKeyToHex converts the public keys of the config file, hex or base64
+// encoded as mailproxy accepts both, to the hex encoding used in Config
+func publicKeyToHex(key string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("key is not set")
+	}
+	b, err := hex.DecodeString(key)
+	if err != nil {
+		b, err = base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return "", fmt.Errorf("key is neither hex nor base64 encoded")
+		}
+	}
+	if len(b) != publicKeySize {
+		return "", fmt.Errorf("key is %d bytes long, expected %d", len(b), publicKeySize)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// toBase64 converts public keys as used in Config, hex or base64 encoded,
+// to the base64 encoding of the config file.
+func toBase64(key string) (string, error) {
+	hexKey, err := publicKeyToHex(key)
+	if err != nil {
+		return "", err
+	}
+	b, _ := hex.DecodeString(hexKey)
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func privateToBase64(key *ecdh.PrivateKey) string {
+	if key == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(key.Bytes())
+}
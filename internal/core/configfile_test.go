@@ -0,0 +1,313 @@
+// configfile_test.go - mailproxy configuration file tests
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+)
+
+func genKey(t *testing.T) *ecdh.PrivateKey {
+	key, err := GenKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func publicHex(t *testing.T) string {
+	return hex.EncodeToString(genKey(t).PublicKey().Bytes())
+}
+
+func keyString(key *ecdh.PrivateKey) string {
+	if key == nil {
+		return ""
+	}
+	return KeyToHex(key)
+}
+
+func compareAccounts(t *testing.T, name string, got, expected *Account) {
+	if got.Address() != expected.Address() {
+		t.Errorf("%s: got account %v, expected %v", name, got.Address(), expected.Address())
+	}
+	if keyString(got.IdentityKey) != keyString(expected.IdentityKey) {
+		t.Errorf("%s: %v IdentityKey doesn't match", name, expected.Address())
+	}
+	if keyString(got.LinkKey) != keyString(expected.LinkKey) {
+		t.Errorf("%s: %v LinkKey doesn't match", name, expected.Address())
+	}
+	if keyString(got.StorageKey) != keyString(expected.StorageKey) {
+		t.Errorf("%s: %v StorageKey doesn't match", name, expected.Address())
+	}
+	if got.ProviderKeyPin != expected.ProviderKeyPin {
+		t.Errorf("%s: got ProviderKeyPin %v, expected %v", name, got.ProviderKeyPin, expected.ProviderKeyPin)
+	}
+	if got.InsecureKeyDiscovery != expected.InsecureKeyDiscovery {
+		t.Errorf("%s: %v InsecureKeyDiscovery doesn't match", name, expected.Address())
+	}
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	configs := map[string]*Config{
+		"nonvoting": {
+			PkiAddress:  "127.0.0.1:29483",
+			PkiKey:      publicHex(t),
+			User:        "alice",
+			Provider:    "provider",
+			IdentityKey: genKey(t),
+			LinkKey:     genKey(t),
+			DataDir:     path.Join(dir, "nonvoting"),
+		},
+		"voting": {
+			Authorities: []*Authority{
+				{IdentityKey: publicHex(t), LinkKey: publicHex(t), Addresses: []string{"127.0.0.1:29484", "[::1]:29484"}},
+				{IdentityKey: publicHex(t), LinkKey: publicHex(t), Addresses: []string{"127.0.0.1:29485"}},
+			},
+			User:     "bob",
+			Provider: "provider",
+			DataDir:  path.Join(dir, "voting"),
+		},
+		"everything": {
+			PkiAddress:           "127.0.0.1:29483",
+			PkiKey:               publicHex(t),
+			User:                 "carol",
+			Provider:             "provider",
+			IdentityKey:          genKey(t),
+			LinkKey:              genKey(t),
+			ProviderKeyPin:       publicHex(t),
+			StorageKey:           genKey(t),
+			InsecureKeyDiscovery: true,
+			Accounts: []*Account{
+				{User: "dave", Provider: "other", IdentityKey: genKey(t), LinkKey: genKey(t), ProviderKeyPin: publicHex(t)},
+				{User: "erin", Provider: "provider", StorageKey: genKey(t), InsecureKeyDiscovery: true},
+			},
+			SMTPAddress:     "127.0.0.1:2526",
+			POP3Address:     "127.0.0.1:2527",
+			LaunchListeners: true,
+			Log:             &LogConfig{File: "katzenpost.log", Level: "DEBUG", Enabled: true},
+			UpstreamProxy:   &UpstreamProxy{Type: ProxyTorSOCKS5, Network: "tcp", Address: "127.0.0.1:9050"},
+			DataDir:         path.Join(dir, "everything"),
+		},
+	}
+
+	for name, cfg := range configs {
+		cfgPath := path.Join(dir, name+".toml")
+		if err := cfg.Save(cfgPath); err != nil {
+			t.Fatalf("%s: can't save: %v", name, err)
+		}
+		loaded, err := LoadConfig(cfgPath)
+		if err != nil {
+			t.Fatalf("%s: can't load: %v", name, err)
+		}
+
+		if loaded.DataDir != cfg.DataDir {
+			t.Errorf("%s: got DataDir %v, expected %v", name, loaded.DataDir, cfg.DataDir)
+		}
+		if loaded.PkiAddress != cfg.PkiAddress || loaded.PkiKey != cfg.PkiKey {
+			t.Errorf("%s: got authority %v %v, expected %v %v", name, loaded.PkiAddress, loaded.PkiKey, cfg.PkiAddress, cfg.PkiKey)
+		}
+		if !reflect.DeepEqual(loaded.Authorities, cfg.Authorities) {
+			t.Errorf("%s: voting authorities don't match", name)
+		}
+		compareAccounts(t, name, loaded.getAccount(), cfg.getAccount())
+		if len(loaded.Accounts) != len(cfg.Accounts) {
+			t.Fatalf("%s: got %d accounts, expected %d", name, len(loaded.Accounts), len(cfg.Accounts))
+		}
+		for i := range cfg.Accounts {
+			compareAccounts(t, name, loaded.Accounts[i], cfg.Accounts[i])
+		}
+		if loaded.SMTPAddress != cfg.SMTPAddress || loaded.POP3Address != cfg.POP3Address || loaded.LaunchListeners != cfg.LaunchListeners {
+			t.Errorf("%s: listeners don't match", name)
+		}
+		if !reflect.DeepEqual(loaded.getLogging(), cfg.getLogging()) {
+			t.Errorf("%s: got logging %v, expected %v", name, loaded.getLogging(), cfg.getLogging())
+		}
+		if !reflect.DeepEqual(loaded.getUpstreamProxy(), cfg.getUpstreamProxy()) {
+			t.Errorf("%s: got upstream proxy %v, expected %v", name, loaded.getUpstreamProxy(), cfg.getUpstreamProxy())
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	pkiKey := privateToBase64(genKey(t))
+	authority := fmt.Sprintf(`
+[NonvotingAuthority.Provider]
+  Address = "127.0.0.1:29483"
+  PublicKey = "%s"
+`, pkiKey)
+	proxy := `
+[Proxy]
+  DataDir = "/tmp/katzenpost"
+`
+	account := `
+[[Account]]
+  User = "alice"
+  Provider = "provider"
+  Authority = "Provider"
+`
+
+	tests := []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{"valid", proxy + authority + account, ""},
+		{"no DataDir", "[Proxy]\n" + authority + account, "DataDir is not set"},
+		{"no Proxy", authority + account, "DataDir is not set"},
+		{"no account", proxy + authority, "No Account configured"},
+		{"no authority", proxy + account, "Exactly one NonvotingAuthority or VotingAuthority"},
+		{"wrong authority", proxy + authority + strings.Replace(account, `"Provider"`, `"Other"`, 1), "Authority Other is not configured"},
+		{"no user", proxy + authority + strings.Replace(account, `User = "alice"`, "", 1), "User is not set"},
+		{"bad authority key", proxy + strings.Replace(authority, pkiKey, "not base64!", 1) + account, "Invalid PublicKey"},
+		{"bad identity key", proxy + authority + account + `  IdentityKey = "not base64!"`, "Invalid IdentityKey"},
+		{"bad link key", proxy + authority + account + `  LinkKey = "AAAA"`, "Invalid LinkKey"},
+		{"bad storage key", proxy + authority + account + `  StorageKey = "AAAA"`, "Invalid StorageKey"},
+		{"bad provider pin", proxy + authority + account + `  ProviderKeyPin = "not base64!"`, "Invalid ProviderKeyPin"},
+		{"unknown key", proxy + authority + account + `  Unknown = true`, "Undecoded keys"},
+		{"management", proxy + authority + account + "\n[Management]\n  Enable = true\n", "Management is not supported"},
+		{"debug", proxy + authority + account + "\n[Debug]\n  ReceiveTimeout = 600\n", "Debug is not supported"},
+		{"recipients", proxy + authority + account + "\n[Recipients]\n  \"bob@provider\" = \"key\"\n", "Recipients is not supported"},
+	}
+
+	for _, test := range tests {
+		cfgPath := path.Join(dir, "katzenpost.toml")
+		if err := ioutil.WriteFile(cfgPath, []byte(test.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadConfig(cfgPath)
+		switch {
+		case test.expected == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.expected != "" && err == nil:
+			t.Errorf("%s: no error, expected %q", test.name, test.expected)
+		case test.expected != "" && !strings.Contains(err.Error(), test.expected):
+			t.Errorf("%s: got error %q, expected %q", test.name, err, test.expected)
+		}
+	}
+}
+
+func TestLoadConfigLaunchListeners(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		proxy    string
+		expected bool
+	}{
+		{``, true},
+		{`NoLaunchListeners = true`, false},
+		{`SMTPAddress = "127.0.0.1:2526"`, true},
+		{"SMTPAddress = \"127.0.0.1:2526\"\n  NoLaunchListeners = true", false},
+	}
+	for _, test := range tests {
+		config := fmt.Sprintf(`
+[Proxy]
+  DataDir = "/tmp/katzenpost"
+  %s
+
+[NonvotingAuthority.Provider]
+  Address = "127.0.0.1:29483"
+  PublicKey = "%s"
+
+[[Account]]
+  User = "alice"
+  Provider = "provider"
+  Authority = "Provider"
+`, test.proxy, privateToBase64(genKey(t)))
+		cfgPath := path.Join(dir, "katzenpost.toml")
+		if err := ioutil.WriteFile(cfgPath, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfig(cfgPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.LaunchListeners != test.expected {
+			t.Errorf("%q: got LaunchListeners %v, expected %v", test.proxy, cfg.LaunchListeners, test.expected)
+		}
+	}
+}
+
+func TestLoadConfigKeyEncodings(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	keyHex := publicHex(t)
+	keyBytes, _ := hex.DecodeString(keyHex)
+	keyBase64 := base64.StdEncoding.EncodeToString(keyBytes)
+
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{keyHex, keyHex},
+		{strings.ToUpper(keyHex), keyHex},
+		{keyBase64, keyHex},
+		{keyHex[:62], ""},
+		{base64.StdEncoding.EncodeToString(keyBytes[:31]), ""},
+		{"not a key", ""},
+	}
+	for _, test := range tests {
+		config := fmt.Sprintf(`
+[Proxy]
+  DataDir = "/tmp/katzenpost"
+
+[NonvotingAuthority.Provider]
+  Address = "127.0.0.1:29483"
+  PublicKey = "%s"
+
+[[Account]]
+  User = "alice"
+  Provider = "provider"
+  Authority = "Provider"
+  ProviderKeyPin = "%s"
+`, test.key, test.key)
+		cfgPath := path.Join(dir, "katzenpost.toml")
+		if err := ioutil.WriteFile(cfgPath, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfig(cfgPath)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%q: invalid key accepted", test.key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.key, err)
+			continue
+		}
+		if cfg.PkiKey != test.expected || cfg.ProviderKeyPin != test.expected {
+			t.Errorf("%q: got keys %v and %v, expected %v", test.key, cfg.PkiKey, cfg.ProviderKeyPin, test.expected)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+// connection.go - connection state and reconnection
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNotConnected is returned by WaitToConnect when the connection attempt
+// failed
+var ErrNotConnected = errors.New("Not connected")
+
+// ConnectionState is the state of the connection to the provider
+type ConnectionState int
+
+const (
+	// StateConnecting is the state while the first connection attempt or a
+	// reconnection is in progress
+	StateConnecting ConnectionState = iota
+
+	// StateConnected is the state while connected to the provider
+	StateConnected
+
+	// StateDisconnected is the state once the connection is lost
+	StateDisconnected
+
+	// StateBackingOff is the state while waiting to reconnect
+	StateBackingOff
+
+	// StateShutdown is the state after Shutdown
+	StateShutdown
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "Connecting"
+	case StateConnected:
+		return "Connected"
+	case StateDisconnected:
+		return "Disconnected"
+	case StateBackingOff:
+		return "BackingOff"
+	case StateShutdown:
+		return "Shutdown"
+	default:
+		return "Unknown"
+	}
+}
+
+// Backoff configures the delay between reconnections, it starts at Initial
+// and gets multiplied by Multiplier on every failed attempt up to Max
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+}
+
+var defaultBackoff = Backoff{
+	Initial:    5 * time.Second,
+	Max:        5 * time.Minute,
+	Multiplier: 2,
+}
+
+func (b *Backoff) delay(attempt int) time.Duration {
+	delay := float64(b.Initial)
+	for i := 0; i < attempt && delay < float64(b.Max); i++ {
+		delay *= b.Multiplier
+	}
+	if delay > float64(b.Max) {
+		return b.Max
+	}
+	return time.Duration(delay)
+}
+
+func (c *Config) getBackoff() Backoff {
+	backoff := defaultBackoff
+	if c.Backoff == nil {
+		return backoff
+	}
+	if c.Backoff.Initial > 0 {
+		backoff.Initial = c.Backoff.Initial
+	}
+	if c.Backoff.Max > 0 {
+		backoff.Max = c.Backoff.Max
+	}
+	if c.Backoff.Multiplier >= 1 {
+		backoff.Multiplier = c.Backoff.Multiplier
+	}
+	return backoff
+}
+
+// connection tracks the state of the default account. The mailproxy keeps
+// retrying on its own, if it's still disconnected when the backoff expires
+// the proxy is restarted.
+type connection struct {
+	sync.Mutex
+	state      ConnectionState
+	err        error
+	changeCh   chan struct{}
+	attempt    int
+	timer      *time.Timer
+	restarting bool
+	backoff    Backoff
+}
+
+func newConnection(backoff Backoff) *connection {
+	return &connection{
+		state:    StateConnecting,
+		changeCh: make(chan struct{}),
+		backoff:  backoff,
+	}
+}
+
+func (c *connection) get() (ConnectionState, chan struct{}, error) {
+	c.Lock()
+	defer c.Unlock()
+	return c.state, c.changeCh, c.err
+}
+
+// set has to be called holding the lock, it returns false if the state
+// didn't change
+func (c *connection) set(state ConnectionState, err error) bool {
+	if c.state == state || c.state == StateShutdown {
+		return false
+	}
+	c.state = state
+	c.err = err
+	close(c.changeCh)
+	c.changeCh = make(chan struct{})
+	return true
+}
+
+func (c *connection) setRestarting(restarting bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.restarting = restarting
+}
+
+func (c *connection) stopTimer() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+// State returns the current connection state
+func (c *Client) State() ConnectionState {
+	state, _, _ := c.conn.get()
+	return state
+}
+
+// WaitToConnect waits until connected. It returns the connection error if
+// the attempt fails and ErrShutdown if the client is shut down.
+func (c *Client) WaitToConnect() error {
+	for {
+		state, changeCh, err := c.conn.get()
+		switch state {
+		case StateConnected:
+			return nil
+		case StateShutdown:
+			return ErrShutdown
+		case StateDisconnected, StateBackingOff:
+			if err != nil {
+				return err
+			}
+			return ErrNotConnected
+		}
+		<-changeCh
+	}
+}
+
+// Reconnect restarts the connection to the provider right away, resetting
+// the backoff. It's useful when the network changes, like on mobile.
+func (c *Client) Reconnect() error {
+	c.conn.Lock()
+	if c.conn.state == StateShutdown {
+		c.conn.Unlock()
+		return ErrShutdown
+	}
+	c.conn.stopTimer()
+	c.conn.attempt = 0
+	c.conn.Unlock()
+	return c.restart()
+}
+
+func (c *Client) setState(state ConnectionState, err error) {
+	c.conn.Lock()
+	changed := c.conn.set(state, err)
+	c.conn.Unlock()
+	if changed {
+		c.events.push(&Event{Type: EventStateChanged, State: state, Err: err})
+	}
+}
+
+// connectionChanged processes the connection events of the default account
+func (c *Client) connectionChanged(isConnected bool, err error) {
+	c.conn.Lock()
+	if c.conn.restarting || c.conn.state == StateShutdown {
+		// the old proxy going down
+		c.conn.Unlock()
+		return
+	}
+	if isConnected {
+		c.conn.stopTimer()
+		c.conn.attempt = 0
+	}
+	c.conn.Unlock()
+
+	if isConnected {
+		c.setState(StateConnected, nil)
+		return
+	}
+	c.setState(StateDisconnected, err)
+	c.scheduleReconnect()
+}
+
+func (c *Client) scheduleReconnect() {
+	c.conn.Lock()
+	defer c.conn.Unlock()
+	if c.conn.state == StateShutdown || c.conn.timer != nil {
+		return
+	}
+
+	delay := c.conn.backoff.delay(c.conn.attempt)
+	c.conn.attempt++
+	c.conn.timer = time.AfterFunc(delay, func() {
+		c.conn.Lock()
+		if c.conn.state == StateShutdown {
+			// Shutdown stopped the timer after it fired
+			c.conn.Unlock()
+			return
+		}
+		c.conn.timer = nil
+		backingOff := c.conn.state == StateBackingOff
+		c.conn.Unlock()
+		if backingOff {
+			c.restart()
+		}
+	})
+	if c.conn.set(StateBackingOff, c.conn.err) {
+		c.events.push(&Event{Type: EventStateChanged, State: StateBackingOff, Err: c.conn.err})
+	}
+}
+
+// restart replaces the mailproxy by a new one. It can't run in the event
+// handler goroutine, the old proxy might emit events while shutting down.
+func (c *Client) restart() error {
+	c.conn.Lock()
+	restarting := c.conn.restarting
+	c.conn.Unlock()
+	if restarting {
+		return nil
+	}
+	c.setState(StateConnecting, nil)
+
+	c.restartLock.Lock()
+	err := c.restartProxy(func() {})
+	c.restartLock.Unlock()
+	if err == ErrShutdown {
+		return err
+	}
+	if err != nil {
+		c.setState(StateDisconnected, err)
+		c.scheduleReconnect()
+	}
+	return err
+}
@@ -0,0 +1,192 @@
+// event.go - mixnet client events
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/mailproxy/event"
+)
+
+// maxQueuedEvents is the number of events kept if nobody is consuming them,
+// the oldest ones get dropped after that.
+const maxQueuedEvents = 1024
+
+// EventType identifies the kind of an Event
+type EventType int
+
+const (
+	// EventConnectionStatus is emitted when the connection to the provider
+	// goes up or down. IsConnected and Err are set.
+	EventConnectionStatus EventType = iota
+
+	// EventMessageReceived is emitted when a message arrives to the spool.
+	// MessageID and SenderKey are set.
+	EventMessageReceived
+
+	// EventMessageSent is emitted when a message was fully transmitted.
+	// MessageID is set, Err is not nil if the transmission failed.
+	EventMessageSent
+
+	// EventKaetzchenReply is emitted when a Kaetzchen request completes.
+	// MessageID and Payload are set, Err is not nil on failures.
+	EventKaetzchenReply
+
+	// EventError is emitted when the client hits an error processing
+	// other events or refreshing the pinned key of a contact. Err is set,
+	// and Address for the key refreshes.
+	EventError
+
+	// EventKeyChanged is emitted when the key fetched for a contact doesn't
+	// match the pinned one. Address and Err, a *KeyChangedError, are set.
+	EventKeyChanged
+
+	// EventStateChanged is emitted when the connection state changes. State
+	// is set, Err is set if the change was caused by an error.
+	EventStateChanged
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnectionStatus:
+		return "ConnectionStatus"
+	case EventMessageReceived:
+		return "MessageReceived"
+	case EventMessageSent:
+		return "MessageSent"
+	case EventKaetzchenReply:
+		return "KaetzchenReply"
+	case EventError:
+		return "Error"
+	case EventKeyChanged:
+		return "KeyChanged"
+	case EventStateChanged:
+		return "StateChanged"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event is a notification from the client, only the fields relevant to its
+// Type are set
+type Event struct {
+	Type        EventType
+	AccountID   string
+	Address     string
+	MessageID   []byte
+	SenderKey   *ecdh.PublicKey
+	Payload     []byte
+	IsConnected bool
+	State       ConnectionState
+	Err         error
+}
+
+func newEvent(ev event.Event) *Event {
+	switch ev := ev.(type) {
+	case *event.ConnectionStatusEvent:
+		return &Event{
+			Type:        EventConnectionStatus,
+			AccountID:   ev.AccountID,
+			IsConnected: ev.IsConnected,
+			Err:         ev.Err,
+		}
+	case *event.MessageReceivedEvent:
+		return &Event{
+			Type:      EventMessageReceived,
+			AccountID: ev.AccountID,
+			MessageID: ev.MessageID,
+			SenderKey: ev.SenderKey,
+		}
+	case *event.MessageSentEvent:
+		return &Event{
+			Type:      EventMessageSent,
+			AccountID: ev.AccountID,
+			MessageID: ev.MessageID,
+			Err:       ev.Err,
+		}
+	case *event.KaetzchenReplyEvent:
+		return &Event{
+			Type:      EventKaetzchenReply,
+			AccountID: ev.AccountID,
+			MessageID: ev.MessageID,
+			Payload:   ev.Payload,
+			Err:       ev.Err,
+		}
+	default:
+		return nil
+	}
+}
+
+type eventQueue struct {
+	sync.Mutex
+	events   []*Event
+	notifyCh chan struct{}
+}
+
+func newEventQueue() *eventQueue {
+	return &eventQueue{notifyCh: make(chan struct{}, 1)}
+}
+
+func (q *eventQueue) push(ev *Event) {
+	q.Lock()
+	if len(q.events) >= maxQueuedEvents {
+		q.events = q.events[1:]
+	}
+	q.events = append(q.events, ev)
+	q.Unlock()
+
+	select {
+	case q.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (q *eventQueue) pop() *Event {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.events) == 0 {
+		return nil
+	}
+	ev := q.events[0]
+	q.events = q.events[1:]
+	return ev
+}
+
+// NextEvent returns the oldest event not yet consumed, waiting for one up to
+// timeout. A timeout of 0 blocks until an event arrives.
+func (c *Client) NextEvent(timeout time.Duration) (*Event, error) {
+	var timeoutCh <-chan time.Time
+	if timeout != 0 {
+		timeoutCh = time.After(timeout)
+	}
+
+	for {
+		if ev := c.events.pop(); ev != nil {
+			return ev, nil
+		}
+
+		select {
+		case <-c.events.notifyCh:
+		case <-timeoutCh:
+			return nil, ErrTimeout
+		case <-c.haltCh:
+			return nil, ErrShutdown
+		}
+	}
+}
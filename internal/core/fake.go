@@ -0,0 +1,405 @@
+// fake.go - in-memory mixnet for tests
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/mailproxy"
+	"github.com/katzenpost/mailproxy/event"
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	fakeEventQueue = 1024
+
+	// loopService echoes the payload back
+	loopService = "loop"
+
+	fakeKeyserverNoKey = 1
+)
+
+var (
+	// ErrFakeLoss is the error of the messages dropped by a FakeNetwork
+	ErrFakeLoss = errors.New("Message lost by the fake network")
+)
+
+// FakeNetwork is an in-memory mixnet for tests. The clients with it in their
+// Config send messages to each other through it, delivered after Latency and
+// dropping a Loss fraction, between 0 and 1, of them. Every provider offers
+// the keyserver and loop Kaetzchen services, and the HTTP key discovery is
+// answered by the network too. The messages of accounts not running are kept
+// until a client with them starts.
+type FakeNetwork struct {
+	Latency time.Duration
+	Loss    float64
+
+	lock      sync.Mutex
+	providers map[string]bool
+	keys      map[string]*ecdh.PrivateKey
+	spools    map[string][]*mailproxy.Message
+	backends  map[string]*fakeBackend
+}
+
+// NewFakeNetwork creates an empty fake network
+func NewFakeNetwork(latency time.Duration, loss float64) *FakeNetwork {
+	return &FakeNetwork{
+		Latency:   latency,
+		Loss:      loss,
+		providers: make(map[string]bool),
+		keys:      make(map[string]*ecdh.PrivateKey),
+		spools:    make(map[string][]*mailproxy.Message),
+		backends:  make(map[string]*fakeBackend),
+	}
+}
+
+// AddProvider adds a provider to the PKI document, the providers of the
+// client accounts are added when they start
+func (n *FakeNetwork) AddProvider(name string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.providers[name] = true
+}
+
+// attach registers the accounts of the client
+func (n *FakeNetwork) attach(c *Client, accounts []*Account) (backend, error) {
+	if n.Loss < 0 || n.Loss > 1 {
+		return nil, fmt.Errorf("Invalid FakeNetwork Loss %v, it has to be between 0 and 1", n.Loss)
+	}
+
+	b := &fakeBackend{
+		network:    n,
+		sink:       c.eventSink,
+		events:     make(chan event.Event, fakeEventQueue),
+		haltCh:     make(chan struct{}),
+		accounts:   make(map[string]bool),
+		recipients: make(map[string]*ecdh.PublicKey),
+	}
+
+	n.lock.Lock()
+	for _, account := range accounts {
+		address := account.Address()
+		if account.IdentityKey != nil {
+			n.keys[address] = account.IdentityKey
+		} else if _, ok := n.keys[address]; !ok {
+			key, err := GenKey()
+			if err != nil {
+				n.lock.Unlock()
+				return nil, err
+			}
+			n.keys[address] = key
+		}
+		n.providers[account.Provider] = true
+		n.backends[address] = b
+		b.accounts[address] = true
+	}
+	n.lock.Unlock()
+
+	go b.forwardEvents()
+	for address := range b.accounts {
+		b.emit(&event.ConnectionStatusEvent{AccountID: address, IsConnected: true})
+	}
+	return b, nil
+}
+
+func (n *FakeNetwork) lost() bool {
+	return n.Loss > 0 && mrand.Float64() < n.Loss
+}
+
+// deliver puts the message in the recipient spool, it returns the backend
+// of the recipient if it's running
+func (n *FakeNetwork) deliver(sender, recipient string, recipientKey *ecdh.PublicKey, payload []byte) (*fakeBackend, *ecdh.PublicKey, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	key, ok := n.keys[recipient]
+	if !ok {
+		return nil, nil, errors.New("Unknown recipient " + recipient)
+	}
+	if key.PublicKey().String() != recipientKey.String() {
+		return nil, nil, errors.New("Wrong key for recipient " + recipient)
+	}
+
+	senderKey := n.keys[sender].PublicKey()
+	n.spools[recipient] = append(n.spools[recipient], &mailproxy.Message{
+		SenderID:  sender,
+		SenderKey: senderKey,
+		Payload:   payload,
+	})
+	return n.backends[recipient], senderKey, nil
+}
+
+// publicKey replaces the HTTP key endpoint of the providers
+func (n *FakeNetwork) publicKey(address string) (*ecdh.PublicKey, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	key, ok := n.keys[normalizeAddress(address)]
+	if !ok {
+		return nil, errors.New("Can't fetch key for address: unknown user " + address)
+	}
+	return key.PublicKey(), nil
+}
+
+func (n *FakeNetwork) keyserver(provider string, payload []byte) ([]byte, error) {
+	var request keyserverRequest
+	if err := codec.NewDecoderBytes(payload, &codec.CborHandle{}).Decode(&request); err != nil {
+		return nil, err
+	}
+
+	response := keyserverResponse{
+		Version:    keyserverVersion,
+		StatusCode: fakeKeyserverNoKey,
+		User:       request.User,
+	}
+	n.lock.Lock()
+	if key, ok := n.keys[normalizeAddress(request.User+"@"+provider)]; ok {
+		response.StatusCode = keyserverStatusOk
+		response.PublicKey = key.PublicKey().String()
+	}
+	n.lock.Unlock()
+
+	var reply []byte
+	err := codec.NewEncoderBytes(&reply, &codec.CborHandle{}).Encode(&response)
+	return reply, err
+}
+
+type fakeBackend struct {
+	network *FakeNetwork
+	sink    chan event.Event
+	events  chan event.Event
+	haltCh  chan struct{}
+	once    sync.Once
+
+	// accounts is not modified after attach
+	accounts map[string]bool
+
+	lock       sync.Mutex
+	recipients map[string]*ecdh.PublicKey
+}
+
+// forwardEvents keeps the order of the events
+func (b *fakeBackend) forwardEvents() {
+	for {
+		select {
+		case ev := <-b.events:
+			select {
+			case b.sink <- ev:
+			case <-b.haltCh:
+				return
+			}
+		case <-b.haltCh:
+			return
+		}
+	}
+}
+
+func (b *fakeBackend) emit(ev event.Event) {
+	select {
+	case b.events <- ev:
+	case <-b.haltCh:
+	}
+}
+
+func (b *fakeBackend) Shutdown() {
+	b.once.Do(func() {
+		close(b.haltCh)
+
+		n := b.network
+		n.lock.Lock()
+		defer n.lock.Unlock()
+		for address := range b.accounts {
+			if n.backends[address] == b {
+				delete(n.backends, address)
+			}
+		}
+	})
+}
+
+func (b *fakeBackend) ListProviders(authorityID string) ([]*pki.MixDescriptor, error) {
+	return b.network.providerDescriptors(), nil
+}
+
+func (n *FakeNetwork) providerDescriptors() []*pki.MixDescriptor {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	names := make([]string, 0, len(n.providers))
+	for name := range n.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	providers := make([]*pki.MixDescriptor, len(names))
+	for i, name := range names {
+		providers[i] = &pki.MixDescriptor{
+			Name:      name,
+			Addresses: map[pki.Transport][]string{pki.TransportTCPv4: {"127.0.0.1:0"}},
+			Kaetzchen: map[string]map[string]interface{}{
+				keyserverService: {"endpoint": "+" + keyserverService},
+				loopService:      {"endpoint": "+" + loopService},
+			},
+			Layer: pki.LayerProvider,
+		}
+	}
+	return providers
+}
+
+// fakePKI serves documents with the fake providers and no mixes
+type fakePKI struct {
+	network *FakeNetwork
+}
+
+func (p *fakePKI) Get(ctx context.Context, epoch uint64) (*pki.Document, []byte, error) {
+	doc := &pki.Document{
+		Epoch:     epoch,
+		Providers: p.network.providerDescriptors(),
+	}
+	return doc, nil, nil
+}
+
+func (b *fakeBackend) SetRecipient(recipientID string, publicKey *ecdh.PublicKey) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.recipients[normalizeAddress(recipientID)] = publicKey
+	return nil
+}
+
+func (b *fakeBackend) SendMessage(senderID, recipientID string, payload []byte) ([]byte, error) {
+	sender := normalizeAddress(senderID)
+	recipient := normalizeAddress(recipientID)
+	if !b.accounts[sender] {
+		return nil, errors.New("Unknown sender " + senderID)
+	}
+	b.lock.Lock()
+	recipientKey, ok := b.recipients[recipient]
+	b.lock.Unlock()
+	if !ok {
+		return nil, errors.New("Unknown recipient " + recipientID)
+	}
+
+	messageID, err := newFakeMessageID()
+	if err != nil {
+		return nil, err
+	}
+	payload = append([]byte(nil), payload...)
+	time.AfterFunc(b.network.Latency, func() {
+		if b.network.lost() {
+			b.emit(&event.MessageSentEvent{AccountID: sender, MessageID: messageID, Err: ErrFakeLoss})
+			return
+		}
+
+		recipientBackend, senderKey, err := b.network.deliver(sender, recipient, recipientKey, payload)
+		b.emit(&event.MessageSentEvent{AccountID: sender, MessageID: messageID, Err: err})
+		if err == nil {
+			b.emit(&messageAckedEvent{AccountID: sender, MessageID: messageID})
+		}
+		if recipientBackend != nil {
+			recipientBackend.emit(&event.MessageReceivedEvent{
+				AccountID: recipient,
+				SenderKey: senderKey,
+				MessageID: messageID,
+			})
+		}
+	})
+	return messageID, nil
+}
+
+func (b *fakeBackend) SendKaetzchenRequest(senderID, recipient, provider string, payload []byte, wantResponse bool) ([]byte, error) {
+	sender := normalizeAddress(senderID)
+	if !b.accounts[sender] {
+		return nil, errors.New("Unknown sender " + senderID)
+	}
+	b.network.lock.Lock()
+	exists := b.network.providers[provider]
+	b.network.lock.Unlock()
+	if !exists {
+		return nil, errors.New("Unknown provider " + provider)
+	}
+
+	messageID, err := newFakeMessageID()
+	if err != nil {
+		return nil, err
+	}
+	payload = append([]byte(nil), payload...)
+
+	// the request and the reply travel through the network
+	time.AfterFunc(2*b.network.Latency, func() {
+		if !wantResponse {
+			return
+		}
+		if b.network.lost() {
+			b.emit(&event.KaetzchenReplyEvent{AccountID: sender, MessageID: messageID, Err: ErrFakeLoss})
+			return
+		}
+
+		var reply []byte
+		var err error
+		switch recipient {
+		case "+" + keyserverService:
+			reply, err = b.network.keyserver(provider, payload)
+		case "+" + loopService:
+			reply = payload
+		default:
+			err = errors.New("Unknown Kaetzchen endpoint " + recipient)
+		}
+		b.emit(&event.KaetzchenReplyEvent{AccountID: sender, MessageID: messageID, Payload: reply, Err: err})
+	})
+	return messageID, nil
+}
+
+func (b *fakeBackend) ReceivePeek(accountID string) (*mailproxy.Message, error) {
+	return b.receive(accountID, false)
+}
+
+func (b *fakeBackend) ReceivePop(accountID string) (*mailproxy.Message, error) {
+	return b.receive(accountID, true)
+}
+
+func (b *fakeBackend) receive(accountID string, pop bool) (*mailproxy.Message, error) {
+	account := normalizeAddress(accountID)
+	if !b.accounts[account] {
+		return nil, ErrUnknownAccount
+	}
+
+	n := b.network
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	spool := n.spools[account]
+	if len(spool) == 0 {
+		return nil, mailproxy.ErrNoMessages
+	}
+	if pop {
+		n.spools[account] = spool[1:]
+	}
+	return spool[0], nil
+}
+
+func newFakeMessageID() ([]byte, error) {
+	id := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, id)
+	return id, err
+}
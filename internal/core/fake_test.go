@@ -0,0 +1,394 @@
+// fake_test.go - client tests on the fake network
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/mailproxy"
+)
+
+const (
+	testLatency = 10 * time.Millisecond
+	testTimeout = 5 * time.Second
+	testPayload = "hello katzenpost"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "katzenpost-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func fakeConfig(network *FakeNetwork, dataDir, user string) *Config {
+	return &Config{
+		User:        user,
+		Provider:    "provider",
+		FakeNetwork: network,
+		DataDir:     path.Join(dataDir, user),
+	}
+}
+
+func newFakeClient(t *testing.T, network *FakeNetwork, dataDir, user string) *Client {
+	c, err := New(fakeConfig(network, dataDir, user))
+	if err != nil {
+		t.Fatalf("Can't start %s: %v", user, err)
+	}
+	return c
+}
+
+func waitStatus(t *testing.T, c *Client, messageID []byte, status Status) {
+	deadline := time.Now().Add(testTimeout)
+	for {
+		s, err := c.Status(messageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s == status {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Message status is %v, expected %v", s, status)
+		}
+		time.Sleep(testLatency)
+	}
+}
+
+func TestFakeSendReceive(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+	network := NewFakeNetwork(testLatency, 0)
+	alice := newFakeClient(t, network, dataDir, "alice")
+	defer alice.Shutdown()
+	bob := newFakeClient(t, network, dataDir, "bob")
+	defer bob.Shutdown()
+
+	messageID, err := alice.Send(bob.Address(), []byte(testPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := alice.Status(messageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != StatusQueued {
+		t.Errorf("Message status is %v, expected %v", status, StatusQueued)
+	}
+
+	msg, err := bob.GetMessage(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Payload) != testPayload {
+		t.Errorf("Got payload %q, expected %q", msg.Payload, testPayload)
+	}
+	if msg.Sender != alice.Address() {
+		t.Errorf("Got sender %v, expected %v", msg.Sender, alice.Address())
+	}
+	aliceKey, err := network.publicKey(alice.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.SenderKey == nil || msg.SenderKey.String() != aliceKey.String() {
+		t.Errorf("Got sender key %v, expected %v", msg.SenderKey, aliceKey)
+	}
+
+	waitStatus(t, alice, messageID, StatusAcknowledged)
+}
+
+func TestFakeInboxPersistence(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+	network := NewFakeNetwork(testLatency, 0)
+	alice := newFakeClient(t, network, dataDir, "alice")
+	defer alice.Shutdown()
+	bob := newFakeClient(t, network, dataDir, "bob")
+	bobAddress := bob.Address()
+
+	// received while running, left in the inbox
+	messageID, err := alice.Send(bobAddress, []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, alice, messageID, StatusAcknowledged)
+	deadline := time.Now().Add(testTimeout)
+	for bob.inbox.unread(bobAddress) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("The message didn't reach the inbox")
+		}
+		time.Sleep(testLatency)
+	}
+	bob.Shutdown()
+
+	// spooled while not running
+	messageID, err = alice.Send(bobAddress, []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, alice, messageID, StatusAcknowledged)
+
+	bob = newFakeClient(t, network, dataDir, "bob")
+	defer bob.Shutdown()
+	for _, expected := range []string{"first", "second"} {
+		msg, err := bob.GetMessage(testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Payload) != expected {
+			t.Errorf("Got payload %q, expected %q", msg.Payload, expected)
+		}
+	}
+	entries, err := bob.ListInbox(bobAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d messages left in the inbox", len(entries))
+	}
+}
+
+func TestFakeKeyChanged(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+	network := NewFakeNetwork(testLatency, 0)
+	alice := newFakeClient(t, network, dataDir, "alice")
+	defer alice.Shutdown()
+	bob := newFakeClient(t, network, dataDir, "bob")
+	bobAddress := bob.Address()
+
+	if _, err := alice.Send(bobAddress, []byte(testPayload)); err != nil {
+		t.Fatal(err)
+	}
+	pinned, ok := alice.Contacts().Get(bobAddress)
+	if !ok {
+		t.Fatal("Bob's key was not pinned")
+	}
+
+	// bob comes back with a new key and alice's pin is due for a refresh
+	bob.Shutdown()
+	newKey, err := GenKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := fakeConfig(network, dataDir, "bob")
+	cfg.IdentityKey = newKey
+	bob, err = New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Shutdown()
+	alice.contacts.Lock()
+	alice.contacts.contacts[bobAddress].LastFetched = time.Now().Add(-2 * keyRefreshInterval)
+	alice.contacts.Unlock()
+
+	for i := 0; i < 2; i++ {
+		_, err = alice.Send(bobAddress, []byte(testPayload))
+		kerr, ok := err.(*KeyChangedError)
+		if !ok {
+			t.Fatalf("Expected a KeyChangedError, got %v", err)
+		}
+		if kerr.PinnedKey != pinned.PublicKey || kerr.NewKey != newKey.PublicKey().String() {
+			t.Errorf("Wrong keys in %v", kerr)
+		}
+	}
+	contact, _ := alice.Contacts().Get(bobAddress)
+	if contact.PublicKey != pinned.PublicKey {
+		t.Error("The pinned key was replaced")
+	}
+
+	if err := alice.Contacts().Add(bobAddress, newKey.PublicKey().String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.Send(bobAddress, []byte(testPayload)); err != nil {
+		t.Errorf("Can't send after accepting the new key: %v", err)
+	}
+}
+
+func TestFakeLoss(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+	network := NewFakeNetwork(testLatency, 1)
+	alice := newFakeClient(t, network, dataDir, "alice")
+	defer alice.Shutdown()
+	bob := newFakeClient(t, network, dataDir, "bob")
+	defer bob.Shutdown()
+
+	// the key is discovered through the lossy network as well
+	bobKey, err := network.publicKey(bob.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Contacts().Add(bob.Address(), bobKey.String()); err != nil {
+		t.Fatal(err)
+	}
+	messageID, err := alice.Send(bob.Address(), []byte(testPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, alice, messageID, StatusFailed)
+	if _, err := bob.GetMessage(5 * testLatency); err != ErrTimeout {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+}
+
+func TestFakeInvalidLoss(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+
+	for _, loss := range []float64{-0.1, 1.5} {
+		c, err := New(fakeConfig(NewFakeNetwork(testLatency, loss), dataDir, "alice"))
+		if err == nil {
+			c.Shutdown()
+			t.Errorf("Loss %v was accepted", loss)
+		}
+	}
+}
+
+func TestFakeHTTPDiscovery(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+	network := NewFakeNetwork(testLatency, 0)
+	alice := newFakeClient(t, network, dataDir, "alice")
+	defer alice.Shutdown()
+	bob := newFakeClient(t, network, dataDir, "bob")
+	defer bob.Shutdown()
+
+	key, err := NewHTTPDiscovery(alice).Get(alice.Address(), bob.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobKey, err := network.publicKey(bob.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.String() != bobKey.String() {
+		t.Error("Got the wrong key")
+	}
+	if _, err := NewHTTPDiscovery(alice).Get(alice.Address(), "nobody@provider"); err == nil {
+		t.Error("Got a key for an unknown user")
+	}
+}
+
+func TestFakeConcurrentFetch(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+	network := NewFakeNetwork(testLatency, 0)
+	bob := newFakeClient(t, network, dataDir, "bob")
+	defer bob.Shutdown()
+	bobAddress := bob.Address()
+
+	const numMessages = 50
+	network.lock.Lock()
+	for i := 0; i < numMessages; i++ {
+		network.spools[bobAddress] = append(network.spools[bobAddress], &mailproxy.Message{
+			SenderID: "alice@provider",
+			Payload:  []byte(strconv.Itoa(i)),
+		})
+	}
+	network.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := bob.fetchSpool(bobAddress); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries, err := bob.ListInbox(bobAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != numMessages {
+		t.Fatalf("Got %d messages in the inbox, expected %d", len(entries), numMessages)
+	}
+	for i, entry := range entries {
+		msg, err := bob.PeekMessage(bobAddress, entry.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Payload) != strconv.Itoa(i) {
+			t.Errorf("Got message %q, expected %d", msg.Payload, i)
+		}
+	}
+}
+
+type testHandler struct {
+	messages chan *Message
+}
+
+func (h *testHandler) ReceivedMessage(msg *Message)                  { h.messages <- msg }
+func (h *testHandler) ReceivedACK(messageID []byte, err error)       {}
+func (h *testHandler) ConnectionChanged(isConnected bool, err error) {}
+
+func TestFakeHandlerGetsInbox(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+	network := NewFakeNetwork(testLatency, 0)
+	alice := newFakeClient(t, network, dataDir, "alice")
+	defer alice.Shutdown()
+	bob := newFakeClient(t, network, dataDir, "bob")
+	bobAddress := bob.Address()
+	bob.Shutdown()
+
+	// received while bob was not running, fetched by New
+	messageID, err := alice.Send(bobAddress, []byte(testPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, alice, messageID, StatusAcknowledged)
+	bob = newFakeClient(t, network, dataDir, "bob")
+	defer bob.Shutdown()
+
+	handler := &testHandler{make(chan *Message, 1)}
+	bob.SetHandler(handler)
+	select {
+	case msg := <-handler.messages:
+		if string(msg.Payload) != testPayload {
+			t.Errorf("Got payload %q, expected %q", msg.Payload, testPayload)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("The message in the inbox was not delivered to the handler")
+	}
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		entries, err := bob.ListInbox(bobAddress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The delivered message was not removed from the inbox")
+		}
+		time.Sleep(testLatency)
+	}
+}
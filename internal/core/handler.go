@@ -0,0 +1,57 @@
+// handler.go - mixnet client callbacks
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+// Handler receives the client notifications as they happen. The methods are
+// called from the client goroutines, so they should return quickly.
+type Handler interface {
+	// ReceivedMessage is called for every message received, the message
+	// is removed from the inbox once it returns.
+	ReceivedMessage(msg *Message)
+
+	// ReceivedACK is called when a sent message was fully transmitted,
+	// err is not nil if the transmission failed.
+	ReceivedACK(messageID []byte, err error)
+
+	// ConnectionChanged is called every time the connection to the
+	// provider goes up or down.
+	ConnectionChanged(isConnected bool, err error)
+}
+
+// SetHandler registers a handler for the client notifications. While a
+// handler is set received messages are delivered to it instead of being
+// returned by GetMessage, starting with the ones already in the inbox. A
+// nil handler goes back to polling.
+func (c *Client) SetHandler(handler Handler) {
+	c.handlerLock.Lock()
+	c.handler = handler
+	c.handlerLock.Unlock()
+
+	if handler != nil {
+		go func() {
+			for _, account := range c.Accounts() {
+				c.deliverInbox(account)
+			}
+		}()
+	}
+}
+
+func (c *Client) getHandler() Handler {
+	c.handlerLock.RLock()
+	defer c.handlerLock.RUnlock()
+	return c.handler
+}
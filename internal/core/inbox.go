@@ -0,0 +1,424 @@
+// inbox.go - local persistent inbox
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/mailproxy"
+)
+
+const (
+	inboxDir       = "inbox"
+	inboxExt       = ".json"
+	inboxSealedExt = ".box"
+)
+
+// ErrNotInInbox is returned when the message is not in the inbox
+var ErrNotInInbox = errors.New("Message not in the inbox")
+
+// InboxEntry is the metadata of a message in the inbox
+type InboxEntry struct {
+	ID       string
+	Account  string
+	Sender   string
+	Received time.Time
+	Size     int
+	Read     bool
+}
+
+type inboxMessage struct {
+	InboxEntry
+	SenderKey string
+	Payload   []byte
+}
+
+// sealer encrypts the inbox files, it's implemented by the MessageStore
+type sealer interface {
+	seal(data []byte) ([]byte, error)
+	open(box []byte) ([]byte, error)
+}
+
+// inbox keeps the received messages on disk until the application deletes
+// them, encrypted if box is set. Messages are moved from the mailproxy spool
+// to the inbox peeking and only popping them once stored, so a crash might
+// duplicate a message but never lose it.
+type inbox struct {
+	sync.Mutex
+	path    string
+	box     sealer
+	entries map[string]*InboxEntry
+}
+
+// openInbox loads the inbox, the messages stored in cleartext before box was
+// configured get encrypted
+func openInbox(dataDir string, box sealer) (*inbox, error) {
+	i := &inbox{
+		path:    path.Join(dataDir, inboxDir),
+		box:     box,
+		entries: make(map[string]*InboxEntry),
+	}
+	if err := os.MkdirAll(i.path, 0700); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(i.path)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		var msg *inboxMessage
+		filePath := path.Join(i.path, f.Name())
+		switch {
+		case strings.HasSuffix(f.Name(), inboxSealedExt):
+			if box == nil {
+				return nil, errors.New("The inbox is encrypted, StorePassphrase is required")
+			}
+			msg, err = i.readFile(filePath, true)
+		case strings.HasSuffix(f.Name(), inboxExt):
+			msg, err = i.readFile(filePath, false)
+			if err == nil && box != nil {
+				err = i.write(msg)
+				if err == nil {
+					err = os.Remove(filePath)
+				}
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry := msg.InboxEntry
+		i.entries[entry.ID] = &entry
+	}
+	return i, nil
+}
+
+func (i *inbox) add(account string, msg *mailproxy.Message) error {
+	id, err := newInboxID()
+	if err != nil {
+		return err
+	}
+	stored := &inboxMessage{
+		InboxEntry: InboxEntry{
+			ID:       id,
+			Account:  account,
+			Sender:   msg.SenderID,
+			Received: time.Now(),
+			Size:     len(msg.Payload),
+		},
+		Payload: msg.Payload,
+	}
+	if msg.SenderKey != nil {
+		stored.SenderKey = msg.SenderKey.String()
+	}
+
+	i.Lock()
+	defer i.Unlock()
+	if err := i.write(stored); err != nil {
+		return err
+	}
+	i.entries[id] = &stored.InboxEntry
+	return nil
+}
+
+// list returns the entries of account, oldest first
+func (i *inbox) list(account string) []*InboxEntry {
+	i.Lock()
+	defer i.Unlock()
+
+	var entries []*InboxEntry
+	for _, entry := range i.entries {
+		if entry.Account == account {
+			e := *entry
+			entries = append(entries, &e)
+		}
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].ID < entries[b].ID })
+	return entries
+}
+
+func (i *inbox) get(account, id string) (*InboxEntry, error) {
+	i.Lock()
+	defer i.Unlock()
+
+	entry, ok := i.entries[id]
+	if !ok || entry.Account != account {
+		return nil, ErrNotInInbox
+	}
+	e := *entry
+	return &e, nil
+}
+
+// pop removes the oldest message of account returning it, nil if the inbox
+// is empty
+func (i *inbox) pop(account string) (*Message, error) {
+	i.Lock()
+	defer i.Unlock()
+
+	var oldest *InboxEntry
+	for _, entry := range i.entries {
+		if entry.Account == account && (oldest == nil || entry.ID < oldest.ID) {
+			oldest = entry
+		}
+	}
+	if oldest == nil {
+		return nil, nil
+	}
+	stored, err := i.read(oldest.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(i.messagePath(oldest.ID)); err != nil {
+		return nil, err
+	}
+	delete(i.entries, oldest.ID)
+	return stored.message(), nil
+}
+
+func (i *inbox) unread(account string) int {
+	i.Lock()
+	defer i.Unlock()
+
+	count := 0
+	for _, entry := range i.entries {
+		if entry.Account == account && !entry.Read {
+			count++
+		}
+	}
+	return count
+}
+
+// peek returns the message and marks it as read
+func (i *inbox) peek(account, id string) (*Message, error) {
+	i.Lock()
+	defer i.Unlock()
+
+	entry, ok := i.entries[id]
+	if !ok || entry.Account != account {
+		return nil, ErrNotInInbox
+	}
+	stored, err := i.read(id)
+	if err != nil {
+		return nil, err
+	}
+	if !stored.Read {
+		stored.Read = true
+		if err := i.write(stored); err != nil {
+			return nil, err
+		}
+		entry.Read = true
+	}
+	return stored.message(), nil
+}
+
+func (i *inbox) delete(account, id string) error {
+	i.Lock()
+	defer i.Unlock()
+
+	entry, ok := i.entries[id]
+	if !ok || entry.Account != account {
+		return ErrNotInInbox
+	}
+	if err := os.Remove(i.messagePath(id)); err != nil {
+		return err
+	}
+	delete(i.entries, id)
+	return nil
+}
+
+func (m *inboxMessage) message() *Message {
+	msg := &Message{
+		ID:       m.ID,
+		Account:  m.Account,
+		Sender:   m.Sender,
+		Received: m.Received,
+		Payload:  m.Payload,
+	}
+	if m.SenderKey != "" {
+		var key ecdh.PublicKey
+		if err := key.FromString(m.SenderKey); err == nil {
+			msg.SenderKey = &key
+		}
+	}
+	return msg
+}
+
+func (i *inbox) read(id string) (*inboxMessage, error) {
+	return i.readFile(i.messagePath(id), i.box != nil)
+}
+
+func (i *inbox) readFile(filePath string, sealed bool) (*inboxMessage, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if sealed {
+		data, err = i.box.open(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var msg inboxMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("Invalid inbox message %s: %v", path.Base(filePath), err)
+	}
+	return &msg, nil
+}
+
+func (i *inbox) write(msg *inboxMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if i.box != nil {
+		data, err = i.box.seal(data)
+		if err != nil {
+			return err
+		}
+	}
+	tmpPath := i.messagePath(msg.ID) + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, i.messagePath(msg.ID))
+}
+
+func (i *inbox) messagePath(id string) string {
+	if i.box != nil {
+		return path.Join(i.path, id+inboxSealedExt)
+	}
+	return path.Join(i.path, id+inboxExt)
+}
+
+// newInboxID generates IDs that sort in arrival order
+func newInboxID() (string, error) {
+	random := make([]byte, 4)
+	if _, err := io.ReadFull(rand.Reader, random); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016x%s", time.Now().UnixNano(), hex.EncodeToString(random)), nil
+}
+
+// fetchSpool moves all the messages of account from the mailproxy spool to
+// the inbox, unless the POP3 listener is running
+func (c *Client) fetchSpool(account string) error {
+	c.spoolLock.Lock()
+	defer c.spoolLock.Unlock()
+	if c.ListenersRunning() {
+		return nil
+	}
+
+	proxy := c.getProxy()
+	for {
+		msg, err := proxy.ReceivePeek(account)
+		if err == mailproxy.ErrNoMessages || (err == nil && msg == nil) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := c.storeReceived(account, msg); err != nil {
+			return err
+		}
+		popped, err := proxy.ReceivePop(account)
+		if err != nil {
+			return err
+		}
+
+		// the spool is only modified by us, but if the popped message is not
+		// the peeked one it's kept as well so it doesn't get lost
+		if popped != nil && !sameMessage(msg, popped) {
+			if err := c.storeReceived(account, popped); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *Client) storeReceived(account string, msg *mailproxy.Message) error {
+	if err := c.inbox.add(account, msg); err != nil {
+		return err
+	}
+	c.archiveReceived(account, msg.SenderID, msg.Payload)
+	return nil
+}
+
+func sameMessage(a, b *mailproxy.Message) bool {
+	return a.SenderID == b.SenderID && bytes.Equal(a.Payload, b.Payload)
+}
+
+// ListInbox returns the messages in the inbox of account, oldest first
+func (c *Client) ListInbox(account string) ([]*InboxEntry, error) {
+	if !c.hasAccount(account) {
+		return nil, ErrUnknownAccount
+	}
+	return c.inbox.list(normalizeAddress(account)), nil
+}
+
+// GetInboxEntry returns the metadata of a message in the inbox
+func (c *Client) GetInboxEntry(account, id string) (*InboxEntry, error) {
+	return c.inbox.get(normalizeAddress(account), id)
+}
+
+// PeekMessage returns a message of the inbox without removing it, the
+// message is marked as read
+func (c *Client) PeekMessage(account, id string) (*Message, error) {
+	return c.inbox.peek(normalizeAddress(account), id)
+}
+
+// DeleteMessage removes a message from the inbox, it should be called once
+// the message is processed
+func (c *Client) DeleteMessage(account, id string) error {
+	return c.inbox.delete(normalizeAddress(account), id)
+}
+
+// UnreadCount returns the number of messages in the inbox of account not
+// yet read
+func (c *Client) UnreadCount(account string) (int, error) {
+	if !c.hasAccount(account) {
+		return 0, ErrUnknownAccount
+	}
+	return c.inbox.unread(normalizeAddress(account)), nil
+}
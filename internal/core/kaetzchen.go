@@ -0,0 +1,151 @@
+// kaetzchen.go - provider services queries
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/mailproxy/event"
+)
+
+type replyTracker struct {
+	sync.Mutex
+	pending map[string]chan *event.KaetzchenReplyEvent
+}
+
+func newReplyTracker() *replyTracker {
+	return &replyTracker{pending: make(map[string]chan *event.KaetzchenReplyEvent)}
+}
+
+func (t *replyTracker) deliver(ev *event.KaetzchenReplyEvent) {
+	t.Lock()
+	defer t.Unlock()
+	id := hex.EncodeToString(ev.MessageID)
+	if ch, ok := t.pending[id]; ok {
+		ch <- ev
+		delete(t.pending, id)
+	}
+}
+
+func (t *replyTracker) forget(messageID []byte) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.pending, hex.EncodeToString(messageID))
+}
+
+// Query sends payload from the default account to a Kaetzchen service of
+// the provider and returns its reply, a timeout of 0 waits forever
+func (c *Client) Query(provider, service string, payload []byte, timeout time.Duration) ([]byte, error) {
+	return c.QueryFrom(c.address, provider, service, payload, timeout)
+}
+
+// QueryFrom sends a Kaetzchen query from the given account
+func (c *Client) QueryFrom(account, provider, service string, payload []byte, timeout time.Duration) ([]byte, error) {
+	if !c.hasAccount(account) {
+		return nil, ErrUnknownAccount
+	}
+	return c.kaetzchenRequest(account, provider, service, payload, timeout)
+}
+
+// ListServices returns the Kaetzchen services advertised by the provider in
+// the PKI document
+func (c *Client) ListServices(provider string) ([]string, error) {
+	descriptor, err := c.getProvider(provider)
+	if err != nil {
+		return nil, err
+	}
+	services := make([]string, 0, len(descriptor.Kaetzchen))
+	for service := range descriptor.Kaetzchen {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services, nil
+}
+
+// kaetzchenRequest sends payload to a service of the provider and waits for
+// the reply up to timeout
+func (c *Client) kaetzchenRequest(account, provider, service string, payload []byte, timeout time.Duration) ([]byte, error) {
+	descriptor, err := c.getProvider(provider)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := kaetzchenEndpoint(descriptor, service)
+	if err != nil {
+		return nil, err
+	}
+
+	// hold the lock while sending so the reply can't arrive before we
+	// are waiting for it
+	replyCh := make(chan *event.KaetzchenReplyEvent, 1)
+	c.replies.Lock()
+	messageID, err := c.getProxy().SendKaetzchenRequest(account, endpoint, provider, payload, true)
+	if err != nil {
+		c.replies.Unlock()
+		return nil, err
+	}
+	c.replies.pending[hex.EncodeToString(messageID)] = replyCh
+	c.replies.Unlock()
+
+	var timeoutCh <-chan time.Time
+	if timeout != 0 {
+		timeoutCh = time.After(timeout)
+	}
+
+	select {
+	case reply := <-replyCh:
+		if reply.Err != nil {
+			return nil, reply.Err
+		}
+		return reply.Payload, nil
+	case <-timeoutCh:
+		c.replies.forget(messageID)
+		return nil, ErrTimeout
+	case <-c.haltCh:
+		return nil, ErrShutdown
+	}
+}
+
+func (c *Client) getProvider(name string) (*pki.MixDescriptor, error) {
+	providers, err := c.getProxy().ListProviders(pkiName)
+	if err != nil {
+		return nil, err
+	}
+	for _, provider := range providers {
+		if provider.Name == name {
+			return provider, nil
+		}
+	}
+	return nil, errors.New("Provider doesn't exist in the authority document: " + name)
+}
+
+func kaetzchenEndpoint(provider *pki.MixDescriptor, service string) (string, error) {
+	params, ok := provider.Kaetzchen[service]
+	if !ok {
+		return "", fmt.Errorf("Provider %s doesn't offer the %s service", provider.Name, service)
+	}
+	endpoint, ok := params["endpoint"].(string)
+	if !ok || endpoint == "" {
+		return "", fmt.Errorf("Provider %s has no endpoint for the %s service", provider.Name, service)
+	}
+	return endpoint, nil
+}
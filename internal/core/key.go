@@ -0,0 +1,62 @@
+// key.go - mixnet user key
+// Copyright (C) 2017  Yawning Angel.
+// Copyright (C) 2017  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+)
+
+// GenKey creates a new ecdh key
+func GenKey() (*ecdh.PrivateKey, error) {
+	return ecdh.NewKeypair(rand.Reader)
+}
+
+// HexToKey builds a key from its hex encoded private part
+func HexToKey(keyStr string) (*ecdh.PrivateKey, error) {
+	keyBytes, err := hex.DecodeString(keyStr)
+	if err != nil {
+		return nil, err
+	}
+	return bytesToKey(keyBytes)
+}
+
+// Base64ToKey builds a key from its base64 encoded private part
+func Base64ToKey(keyStr string) (*ecdh.PrivateKey, error) {
+	keyBytes, err := base64.StdEncoding.DecodeString(keyStr)
+	if err != nil {
+		return nil, err
+	}
+	return bytesToKey(keyBytes)
+}
+
+// KeyToHex returns the hex encoding of the private key
+func KeyToHex(key *ecdh.PrivateKey) string {
+	return hex.EncodeToString(key.Bytes())
+}
+
+func bytesToKey(keyBytes []byte) (*ecdh.PrivateKey, error) {
+	var key ecdh.PrivateKey
+	if err := key.FromBytes(keyBytes); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
@@ -0,0 +1,293 @@
+// keydiscovery.go - recipient key lookup
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/pki"
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	// KeyDiscoveryMixnet queries the keyserver Kaetzchen service of the
+	// recipient's provider through the mix network
+	KeyDiscoveryMixnet = "mixnet"
+
+	// KeyDiscoveryHTTP fetches the key in cleartext from the HTTP
+	// endpoint of the recipient's provider, leaking who we talk to
+	KeyDiscoveryHTTP = "http"
+
+	// KeyDiscoveryMixnetHTTPFallback uses the HTTP endpoint only if the
+	// mixnet query fails
+	KeyDiscoveryMixnetHTTPFallback = "mixnet+http"
+)
+
+const (
+	keyserverService  = "keyserver"
+	keyserverVersion  = 0
+	keyserverStatusOk = 0
+	keyQueryTimeout   = 2 * time.Minute
+
+	defaultKeyDiscoveryPort = 7900
+)
+
+type keyserverRequest struct {
+	Version int
+	User    string
+}
+
+type keyserverResponse struct {
+	Version    int
+	StatusCode int
+	User       string
+	PublicKey  string
+}
+
+// KeyDiscovery looks up the identity key of a recipient for the sending
+// account, lookups going over the network should be done from that account
+// so the provider can't link it to others. The returned keys are pinned in
+// the address book by the client.
+type KeyDiscovery interface {
+	Get(account, address string) (*ecdh.PublicKey, error)
+}
+
+type httpDiscovery struct {
+	client *Client
+}
+
+// NewHTTPDiscovery fetches keys in cleartext from the HTTP endpoint of the
+// recipient's provider
+func NewHTTPDiscovery(c *Client) KeyDiscovery {
+	return &httpDiscovery{c}
+}
+
+func (d *httpDiscovery) Get(account, address string) (*ecdh.PublicKey, error) {
+	user, providerName, err := splitAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := d.client.getProvider(providerName)
+	if err != nil {
+		return nil, errors.New("Recipient provider doesn't exist in the authority document: " + providerName)
+	}
+	if n := d.client.cfg.FakeNetwork; n != nil {
+		return n.publicKey(address)
+	}
+	addresses := provider.Addresses[pki.TransportTCPv4]
+	if len(addresses) == 0 {
+		return nil, errors.New("Recipient provider has no TCPv4 address: " + providerName)
+	}
+	providerAddress := strings.Split(addresses[0], ":")[0]
+	endpoint := net.JoinHostPort(providerAddress, strconv.Itoa(d.client.cfg.getKeyDiscoveryPort()))
+
+	httpClient := d.client.cfg.UpstreamProxy.httpClient()
+	resp, err := httpClient.PostForm("http://"+endpoint+"/getidkey", url.Values{"user": {user}})
+	if err != nil {
+		return nil, errors.New("Can't fetch key for address: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	var response struct {
+		Getidkey string
+	}
+	err = decoder.Decode(&response)
+	if err != nil {
+		return nil, errors.New("There was a problem reading the key fetch response: " + err.Error())
+	}
+
+	var key ecdh.PublicKey
+	err = key.FromString(response.Getidkey)
+	if err != nil {
+		return nil, errors.New("Invalid key fetched for " + address + ": " + err.Error())
+	}
+	return &key, nil
+}
+
+func (c *Config) getKeyDiscoveryPort() int {
+	if c.KeyDiscoveryPort == 0 {
+		return defaultKeyDiscoveryPort
+	}
+	return c.KeyDiscoveryPort
+}
+
+type mixnetDiscovery struct {
+	client *Client
+}
+
+// NewMixnetDiscovery queries the keyserver Kaetzchen service of the
+// recipient's provider through the mix network from the sending account
+func NewMixnetDiscovery(c *Client) KeyDiscovery {
+	return &mixnetDiscovery{c}
+}
+
+func (d *mixnetDiscovery) Get(account, address string) (*ecdh.PublicKey, error) {
+	user, providerName, err := splitAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var request []byte
+	err = codec.NewEncoderBytes(&request, &codec.CborHandle{}).Encode(&keyserverRequest{
+		Version: keyserverVersion,
+		User:    user,
+	})
+	if err != nil {
+		return nil, err
+	}
+	reply, err := d.client.kaetzchenRequest(account, providerName, keyserverService, request, keyQueryTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Can't query key for %s: %v", address, err)
+	}
+
+	var response keyserverResponse
+	err = codec.NewDecoderBytes(reply, &codec.CborHandle{}).Decode(&response)
+	if err != nil {
+		return nil, errors.New("There was a problem reading the key query response: " + err.Error())
+	}
+	if response.StatusCode != keyserverStatusOk {
+		return nil, fmt.Errorf("The keyserver of %s has no key for %s (status %d)", providerName, user, response.StatusCode)
+	}
+	if response.User != user {
+		return nil, fmt.Errorf("The keyserver replied with the key of %s instead of %s", response.User, user)
+	}
+
+	var key ecdh.PublicKey
+	err = key.FromString(response.PublicKey)
+	if err != nil {
+		return nil, errors.New("Invalid key fetched for " + address + ": " + err.Error())
+	}
+	return &key, nil
+}
+
+type chainDiscovery []KeyDiscovery
+
+// ChainDiscovery tries each discovery in order until one finds the key, the
+// error of the last one is returned if none does
+func ChainDiscovery(discoveries ...KeyDiscovery) KeyDiscovery {
+	return chainDiscovery(discoveries)
+}
+
+func (d chainDiscovery) Get(account, address string) (*ecdh.PublicKey, error) {
+	err := errors.New("No key discovery configured")
+	for _, discovery := range d {
+		var key *ecdh.PublicKey
+		key, err = discovery.Get(account, address)
+		if err == nil {
+			return key, nil
+		}
+	}
+	return nil, err
+}
+
+type cachedKey struct {
+	key     *ecdh.PublicKey
+	fetched time.Time
+}
+
+type cacheDiscovery struct {
+	sync.Mutex
+	next  KeyDiscovery
+	ttl   time.Duration
+	cache map[string]cachedKey
+}
+
+// CacheDiscovery keeps in memory the keys found by next for ttl
+func CacheDiscovery(next KeyDiscovery, ttl time.Duration) KeyDiscovery {
+	return &cacheDiscovery{
+		next:  next,
+		ttl:   ttl,
+		cache: make(map[string]cachedKey),
+	}
+}
+
+func (d *cacheDiscovery) Get(account, address string) (*ecdh.PublicKey, error) {
+	address = normalizeAddress(address)
+	d.Lock()
+	cached, ok := d.cache[address]
+	d.Unlock()
+	if ok && time.Since(cached.fetched) < d.ttl {
+		return cached.key, nil
+	}
+
+	key, err := d.next.Get(account, address)
+	if err != nil {
+		return nil, err
+	}
+	d.Lock()
+	d.cache[address] = cachedKey{key, time.Now()}
+	d.Unlock()
+	return key, nil
+}
+
+// defaultKeyDiscovery builds the discovery selected in the configuration
+func (c *Client) defaultKeyDiscovery() (KeyDiscovery, error) {
+	switch c.cfg.KeyDiscovery {
+	case "", KeyDiscoveryMixnet:
+		return NewMixnetDiscovery(c), nil
+	case KeyDiscoveryHTTP:
+		return NewHTTPDiscovery(c), nil
+	case KeyDiscoveryMixnetHTTPFallback:
+		return ChainDiscovery(NewMixnetDiscovery(c), NewHTTPDiscovery(c)), nil
+	default:
+		return nil, errors.New("Unknown KeyDiscovery: " + c.cfg.KeyDiscovery)
+	}
+}
+
+// SetKeyDiscovery replaces the way recipient keys are looked up, nil goes
+// back to the one selected in the configuration
+func (c *Client) SetKeyDiscovery(discovery KeyDiscovery) {
+	if discovery == nil {
+		// it was validated on New
+		discovery, _ = c.defaultKeyDiscovery()
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.discovery = discovery
+}
+
+// DefaultKeyDiscovery returns the discovery selected in the configuration,
+// to be chained with application provided ones
+func (c *Client) DefaultKeyDiscovery() KeyDiscovery {
+	discovery, _ := c.defaultKeyDiscovery()
+	return discovery
+}
+
+// KeyDiscovery returns the discovery in use by the client
+func (c *Client) KeyDiscovery() KeyDiscovery {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.discovery
+}
+
+func splitAddress(address string) (user, provider string, err error) {
+	parts := strings.Split(address, "@")
+	if len(parts) != 2 {
+		return "", "", errors.New("Not valid address address: " + address)
+	}
+	return strings.ToLower(parts[0]), parts[1], nil
+}
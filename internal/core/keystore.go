@@ -0,0 +1,191 @@
+// keystore.go - passphrase protected key storage
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	keystoreDir     = "keystore"
+	keystoreExt     = ".key"
+	keystoreVersion = 1
+
+	// argon2id parameters, the interactive ones recommended by the draft RFC
+	argonTime    = 1
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+	argonSaltLen = 16
+	argonKeyLen  = 32
+)
+
+var (
+	// ErrWrongPassphrase is returned when a key can't be decrypted
+	ErrWrongPassphrase = errors.New("Wrong passphrase")
+
+	// ErrKeyExists is returned when storing a key with a name already in use
+	ErrKeyExists = errors.New("Key already exists")
+
+	// ErrUnknownKey is returned when the key is not in the keystore
+	ErrUnknownKey = errors.New("Unknown key")
+)
+
+// Keystore stores private keys in the data dir encrypted with a
+// passphrase. Keys are stored by name, for example "alice@example.com/link"
+// and "alice@example.com/identity".
+type Keystore struct {
+	path string
+}
+
+type storedKey struct {
+	Version   int
+	PublicKey string
+	Salt      []byte
+	Nonce     []byte
+	Box       []byte
+}
+
+// OpenKeystore opens the keystore in dataDir, creating it if needed
+func OpenKeystore(dataDir string) (*Keystore, error) {
+	dataDir, err := resolveDataDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	keystorePath := path.Join(dataDir, keystoreDir)
+	if err := os.MkdirAll(keystorePath, 0700); err != nil {
+		return nil, err
+	}
+	return &Keystore{keystorePath}, nil
+}
+
+// Generate creates a new key and stores it under name
+func (k *Keystore) Generate(name, passphrase string) (*ecdh.PrivateKey, error) {
+	key, err := GenKey()
+	if err != nil {
+		return nil, err
+	}
+	return key, k.Store(name, passphrase, key)
+}
+
+// Store encrypts key with the passphrase and stores it under name
+func (k *Keystore) Store(name, passphrase string, key *ecdh.PrivateKey) error {
+	if name == "" {
+		return errors.New("The key name can't be empty")
+	}
+	keyPath := k.keyPath(name)
+	if _, err := os.Stat(keyPath); err == nil {
+		return ErrKeyExists
+	}
+
+	stored := storedKey{
+		Version:   keystoreVersion,
+		PublicKey: key.PublicKey().String(),
+		Salt:      make([]byte, argonSaltLen),
+		Nonce:     make([]byte, 24),
+	}
+	if _, err := io.ReadFull(rand.Reader, stored.Salt); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rand.Reader, stored.Nonce); err != nil {
+		return err
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], stored.Nonce)
+	secret := deriveKey(passphrase, stored.Salt)
+	stored.Box = secretbox.Seal(nil, key.Bytes(), &nonce, secret)
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyPath, data, 0600)
+}
+
+// Unlock decrypts the key stored under name
+func (k *Keystore) Unlock(name, passphrase string) (*ecdh.PrivateKey, error) {
+	data, err := ioutil.ReadFile(k.keyPath(name))
+	if os.IsNotExist(err) {
+		return nil, ErrUnknownKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stored storedKey
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	if stored.Version != keystoreVersion {
+		return nil, errors.New("Unsupported keystore version")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], stored.Nonce)
+	secret := deriveKey(passphrase, stored.Salt)
+	keyBytes, ok := secretbox.Open(nil, stored.Box, &nonce, secret)
+	if !ok {
+		return nil, ErrWrongPassphrase
+	}
+	return bytesToKey(keyBytes)
+}
+
+// List returns the names of the stored keys
+func (k *Keystore) List() ([]string, error) {
+	files, err := ioutil.ReadDir(k.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), keystoreExt) {
+			continue
+		}
+		name, err := hex.DecodeString(strings.TrimSuffix(f.Name(), keystoreExt))
+		if err != nil {
+			continue
+		}
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// the names are hex encoded so they are safe to use as file names
+func (k *Keystore) keyPath(name string) string {
+	return path.Join(k.path, hex.EncodeToString([]byte(name))+keystoreExt)
+}
+
+func deriveKey(passphrase string, salt []byte) *[32]byte {
+	var key [32]byte
+	copy(key[:], argon2.IDKey([]byte(passphrase), salt, argonTime, argonMemory, argonThreads, argonKeyLen))
+	return &key
+}
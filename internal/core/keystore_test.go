@@ -0,0 +1,148 @@
+// keystore_test.go - passphrase protected key storage tests
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestKeystoreRoundTrip(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+
+	k, err := OpenKeystore(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := k.Generate("alice@provider/link", testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := GenKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Store("alice@provider/identity", testPassphrase, identity); err != nil {
+		t.Fatal(err)
+	}
+
+	k, err = OpenKeystore(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string][]byte{
+		"alice@provider/link":     link.Bytes(),
+		"alice@provider/identity": identity.Bytes(),
+	} {
+		key, err := k.Unlock(name, testPassphrase)
+		if err != nil {
+			t.Fatalf("Can't unlock %s: %v", name, err)
+		}
+		if !bytes.Equal(key.Bytes(), expected) {
+			t.Errorf("Got a different key for %s", name)
+		}
+	}
+
+	names, err := k.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "alice@provider/identity,alice@provider/link" {
+		t.Errorf("Got names %q", names)
+	}
+}
+
+func TestKeystoreErrors(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+
+	k, err := OpenKeystore(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := k.Generate("alice@provider/link", testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := k.Unlock("alice@provider/link", "wrong passphrase"); err != ErrWrongPassphrase {
+		t.Errorf("Got %v with a wrong passphrase, expected ErrWrongPassphrase", err)
+	}
+	if _, err := k.Unlock("bob@provider/link", testPassphrase); err != ErrUnknownKey {
+		t.Errorf("Got %v for a missing key, expected ErrUnknownKey", err)
+	}
+	if err := k.Store("alice@provider/link", testPassphrase, key); err != ErrKeyExists {
+		t.Errorf("Got %v storing over a key, expected ErrKeyExists", err)
+	}
+	if err := k.Store("", testPassphrase, key); err == nil {
+		t.Error("A key with an empty name was stored")
+	}
+}
+
+func TestKeystoreFiles(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+
+	k, err := OpenKeystore(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "../../alice@provider/link"
+	key, err := k.Generate(name, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(path.Join(dataDir, keystoreDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Got %d files in the keystore, expected 1", len(files))
+	}
+	if files[0].Mode().Perm() != 0600 {
+		t.Errorf("Got key file mode %v, expected 0600", files[0].Mode().Perm())
+	}
+	data, err := ioutil.ReadFile(path.Join(dataDir, keystoreDir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, key.Bytes()) || strings.Contains(string(data), hex.EncodeToString(key.Bytes())) {
+		t.Error("The private key is stored in clear")
+	}
+
+	// other files in the keystore dir are ignored
+	if err := ioutil.WriteFile(path.Join(dataDir, keystoreDir, "notes.txt"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dataDir, keystoreDir, "not-hex"+keystoreExt), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	names, err := k.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != name {
+		t.Errorf("Got names %q, expected %q", names, name)
+	}
+}
@@ -0,0 +1,118 @@
+// listeners.go - local SMTP and POP3 listeners
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+	"net"
+)
+
+// Default addresses of the listeners, the same ones as the mailproxy
+const (
+	DefaultSMTPAddress = "127.0.0.1:2525"
+	DefaultPOP3Address = "127.0.0.1:2524"
+)
+
+func (c *Config) getSMTPAddress() string {
+	if c.SMTPAddress == "" {
+		return DefaultSMTPAddress
+	}
+	return c.SMTPAddress
+}
+
+func (c *Config) getPOP3Address() string {
+	if c.POP3Address == "" {
+		return DefaultPOP3Address
+	}
+	return c.POP3Address
+}
+
+// validateListeners only allows loopback addresses, the listeners have no
+// authentication
+func (c *Config) validateListeners() error {
+	for _, address := range []string{c.getSMTPAddress(), c.getPOP3Address()} {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return fmt.Errorf("Invalid listener address %v: %v", address, err)
+		}
+		if host == "localhost" {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return fmt.Errorf("Listener address %v is not a loopback address", address)
+		}
+	}
+	return nil
+}
+
+// StartListeners launches the mailproxy SMTP and POP3 listeners. The
+// mailproxy only launches them on start, so it gets restarted. While they
+// run the received messages are left in the spool for the POP3 clients
+// instead of being moved to the inbox.
+func (c *Client) StartListeners() error {
+	c.restartLock.Lock()
+	defer c.restartLock.Unlock()
+
+	c.lock.Lock()
+	if c.listeners {
+		c.lock.Unlock()
+		return nil
+	}
+	c.listeners = true
+	c.lock.Unlock()
+
+	return c.restartProxy(func() {
+		c.listeners = false
+	})
+}
+
+// StopListeners closes the SMTP and POP3 listeners restarting the mailproxy,
+// the messages not retrieved by the POP3 clients are moved to the inbox
+func (c *Client) StopListeners() error {
+	c.restartLock.Lock()
+	c.lock.Lock()
+	if !c.listeners {
+		c.lock.Unlock()
+		c.restartLock.Unlock()
+		return nil
+	}
+	c.listeners = false
+	c.lock.Unlock()
+
+	err := c.restartProxy(func() {
+		c.listeners = true
+	})
+	c.restartLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, account := range c.Accounts() {
+		if err := c.fetchSpool(account); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListenersRunning reports if the SMTP and POP3 listeners are launched
+func (c *Client) ListenersRunning() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.listeners
+}
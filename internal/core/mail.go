@@ -0,0 +1,424 @@
+// mail.go - RFC 5322 messages
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/core/crypto/rand"
+)
+
+// ErrMessageTooLarge is returned when a mail with attachments gets bigger
+// than MaxMessageSize
+var ErrMessageTooLarge = errors.New("Message too large")
+
+// MaxMessageSize is the biggest mail with attachments we compose. It's not a
+// mailproxy limit, the mailproxy splits messages in blocks retransmitted
+// until acknowledged and bigger ones need too many blocks to get reliably
+// delivered. The mails without attachments and Send are not limited.
+const MaxMessageSize = 256 * 1024
+
+// Mail is an RFC 5322 email message
+type Mail struct {
+	From      string
+	To        string
+	ReplyTo   string
+	Subject   string
+	MessageID string
+	Date      time.Time
+
+	// Header has any other header, on parsed messages it has all of them
+	Header mail.Header
+
+	// Body is the text body of the message, with \n line endings
+	Body string
+
+	// Attachments are sent after the body, on parsed messages they are the
+	// parts with a filename or an attachment disposition
+	Attachments []*Attachment
+
+	// Parts are the decoded body parts of a parsed message
+	Parts []*MailPart
+}
+
+// Attachment is a file attached to a mail
+type Attachment struct {
+	Name        string
+	ContentType string
+	Content     []byte
+}
+
+// MailPart is a decoded body part
+type MailPart struct {
+	ContentType string
+	Filename    string
+	IsAttached  bool
+	Header      textproto.MIMEHeader
+	Body        []byte
+}
+
+// AddAttachment attaches a file to the mail, it fails if the mail would
+// not fit in MaxMessageSize
+func (m *Mail) AddAttachment(name, contentType string, content []byte) error {
+	size := len(m.Body)
+	for _, a := range m.Attachments {
+		size += base64.StdEncoding.EncodedLen(len(a.Content))
+	}
+	size += base64.StdEncoding.EncodedLen(len(content))
+	if size > MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	m.Attachments = append(m.Attachments, &Attachment{name, contentType, content})
+	return nil
+}
+
+// structuredHeaders are written from the Mail fields and not from Header
+var structuredHeaders = map[string]bool{
+	"From":                      true,
+	"To":                        true,
+	"Reply-To":                  true,
+	"Subject":                   true,
+	"Message-Id":                true,
+	"Date":                      true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+}
+
+// Bytes composes the message, the Date and MessageID are generated if not
+// set without modifying m. The addresses are parsed and written back in
+// their canonical form, the headers with line breaks are rejected.
+func (m *Mail) Bytes() ([]byte, error) {
+	if m.From == "" || m.To == "" {
+		return nil, errors.New("The mail needs From and To")
+	}
+	from, err := formatAddress("From", m.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := formatAddress("To", m.To)
+	if err != nil {
+		return nil, err
+	}
+	var replyTo string
+	if m.ReplyTo != "" {
+		replyTo, err = formatAddress("Reply-To", m.ReplyTo)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	messageID := m.MessageID
+	if messageID == "" {
+		messageID, err = newMailMessageID(m.From)
+		if err != nil {
+			return nil, err
+		}
+	} else if err := validateHeader("Message-ID", messageID); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(m.Header))
+	for name, values := range m.Header {
+		if structuredHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+			continue
+		}
+		for _, value := range values {
+			if err := validateHeader(name, value); err != nil {
+				return nil, err
+			}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, a := range m.Attachments {
+		if err := validateHeader("Content-Type", a.ContentType); err != nil {
+			return nil, err
+		}
+		if err := validateHeader("Content-Disposition", a.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	writeHeader(&buf, "From", from)
+	writeHeader(&buf, "To", to)
+	if replyTo != "" {
+		writeHeader(&buf, "Reply-To", replyTo)
+	}
+	writeHeader(&buf, "Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	writeHeader(&buf, "Date", date.Format(time.RFC1123Z))
+	writeHeader(&buf, "Message-ID", messageID)
+	for _, name := range names {
+		for _, value := range m.Header[name] {
+			writeHeader(&buf, name, mime.QEncoding.Encode("utf-8", value))
+		}
+	}
+
+	writeHeader(&buf, "MIME-Version", "1.0")
+	if len(m.Attachments) == 0 {
+		if err := writeTextBody(&buf, m.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := writeMultipart(&buf, m.Body, m.Attachments); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.Attachments) != 0 && buf.Len() > MaxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+func writeHeader(w io.Writer, name, value string) {
+	fmt.Fprintf(w, "%s: %s\r\n", name, value)
+}
+
+// validateHeader rejects the headers that would inject other ones
+func validateHeader(name, value string) error {
+	if name == "" || strings.ContainsAny(name, ": \t\r\n") {
+		return fmt.Errorf("Invalid mail header name %q", name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("Invalid mail header %s: it has line breaks", name)
+	}
+	return nil
+}
+
+func formatAddress(name, address string) (string, error) {
+	addr, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", fmt.Errorf("Invalid %s address %q: %v", name, address, err)
+	}
+	return addr.String(), nil
+}
+
+func writeTextBody(w io.Writer, body string) error {
+	writeHeader(w, "Content-Type", "text/plain; charset=utf-8")
+	writeHeader(w, "Content-Transfer-Encoding", "quoted-printable")
+	io.WriteString(w, "\r\n")
+	qp := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qp, body); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func writeMultipart(w io.Writer, body string, attachments []*Attachment) error {
+	mw := multipart.NewWriter(w)
+	writeHeader(w, "Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()}))
+	io.WriteString(w, "\r\n")
+
+	textHeader := make(textproto.MIMEHeader)
+	textHeader.Set("Content-Type", "text/plain; charset=utf-8")
+	textHeader.Set("Content-Transfer-Encoding", "quoted-printable")
+	part, err := mw.CreatePart(textHeader)
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err := io.WriteString(qp, body); err != nil {
+		return err
+	}
+	if err := qp.Close(); err != nil {
+		return err
+	}
+
+	for _, a := range attachments {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", a.ContentType)
+		header.Set("Content-Transfer-Encoding", "base64")
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Name}))
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		if err := writeBase64Lines(part, a.Content); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// writeBase64Lines writes content base64 encoded in lines of 76 characters
+func writeBase64Lines(w io.Writer, content []byte) error {
+	const lineLen = 76
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > lineLen {
+		if _, err := io.WriteString(w, encoded[:lineLen]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[lineLen:]
+	}
+	_, err := io.WriteString(w, encoded+"\r\n")
+	return err
+}
+
+func newMailMessageID(from string) (string, error) {
+	domain := "katzenpost"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if i := strings.LastIndex(addr.Address, "@"); i != -1 {
+			domain = addr.Address[i+1:]
+		}
+	}
+
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(id), domain), nil
+}
+
+// ParseMail parses a received RFC 5322 message decoding its body parts
+func ParseMail(raw []byte) (*Mail, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Mail{
+		From:      decodeHeader(msg.Header.Get("From")),
+		To:        decodeHeader(msg.Header.Get("To")),
+		ReplyTo:   decodeHeader(msg.Header.Get("Reply-To")),
+		Subject:   decodeHeader(msg.Header.Get("Subject")),
+		MessageID: msg.Header.Get("Message-Id"),
+		Header:    msg.Header,
+	}
+	if date, err := msg.Header.Date(); err == nil {
+		m.Date = date
+	}
+
+	m.Parts, err = parseParts(textproto.MIMEHeader(msg.Header), msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range m.Parts {
+		if part.IsAttached {
+			m.Attachments = append(m.Attachments, &Attachment{part.Filename, part.ContentType, part.Body})
+		} else if part.ContentType == "text/plain" && m.Body == "" {
+			m.Body = strings.Replace(string(part.Body), "\r\n", "\n", -1)
+		}
+	}
+	return m, nil
+}
+
+func decodeHeader(value string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+func parseParts(header textproto.MIMEHeader, body io.Reader) ([]*MailPart, error) {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var parts []*MailPart
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := reader.NextPart()
+			if err == io.EOF {
+				return parts, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			subparts, err := parseParts(p.Header, p)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, subparts...)
+		}
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	part := &MailPart{
+		ContentType: mediaType,
+		Filename:    params["name"],
+		Header:      header,
+		Body:        content,
+	}
+	if disposition, dparams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		if filename := dparams["filename"]; filename != "" {
+			part.Filename = filename
+		}
+		part.IsAttached = disposition == "attachment"
+	}
+	if part.Filename != "" {
+		part.IsAttached = true
+	}
+	return []*MailPart{part}, nil
+}
+
+// SendMail composes the mail and sends it from account to the address in To.
+// From is set to the account address if empty.
+func (c *Client) SendMail(account string, m *Mail) ([]byte, error) {
+	composed := *m
+	if composed.From == "" {
+		composed.From = account
+	}
+	to, err := mail.ParseAddress(composed.To)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid To address %s: %v", composed.To, err)
+	}
+	raw, err := composed.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return c.SendFrom(account, to.Address, raw)
+}
@@ -0,0 +1,319 @@
+// mail_test.go - RFC 5322 messages tests
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMailRoundTrip(t *testing.T) {
+	date := time.Date(2018, 5, 4, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		mail *Mail
+	}{
+		{"plain", &Mail{
+			From:    "alice@provider",
+			To:      "bob@provider",
+			Subject: "hello",
+			Body:    "hello bob\n",
+		}},
+		{"names and reply-to", &Mail{
+			From:    "Alice <alice@provider>",
+			To:      "Bob <bob@provider>",
+			ReplyTo: "alice@other",
+			Subject: "hello",
+			Body:    "hello bob\n",
+		}},
+		{"utf-8", &Mail{
+			From:    "alice@provider",
+			To:      "bob@provider",
+			Subject: "¿qué tal? 🐱",
+			Body:    "ñandú con acentos y líneas muy largas que el quoted-printable tiene que partir en varias porque pasan de los setenta y seis caracteres\n",
+		}},
+		{"headers", &Mail{
+			From:      "alice@provider",
+			To:        "bob@provider",
+			Subject:   "hello",
+			MessageID: "<1234@provider>",
+			Date:      date,
+			Header:    mail.Header{"X-Mailer": {"katzenpost"}, "Keywords": {"one", "two"}},
+			Body:      "hello bob\n",
+		}},
+		{"attachments", &Mail{
+			From:    "alice@provider",
+			To:      "bob@provider",
+			Subject: "files",
+			Body:    "see attached\n",
+			Attachments: []*Attachment{
+				{"notes.txt", "text/plain", []byte("some notes")},
+				{"random.bin", "application/octet-stream", bytes.Repeat([]byte{0, 1, 2, 0xff}, 100)},
+			},
+		}},
+	}
+
+	for _, test := range tests {
+		raw, err := test.mail.Bytes()
+		if err != nil {
+			t.Errorf("%s: can't compose: %v", test.name, err)
+			continue
+		}
+		parsed, err := ParseMail(raw)
+		if err != nil {
+			t.Errorf("%s: can't parse: %v", test.name, err)
+			continue
+		}
+
+		if parsed.From != formatted(t, test.mail.From) || parsed.To != formatted(t, test.mail.To) {
+			t.Errorf("%s: got %q -> %q, expected %q -> %q", test.name, parsed.From, parsed.To, test.mail.From, test.mail.To)
+		}
+		if test.mail.ReplyTo != "" && parsed.ReplyTo != formatted(t, test.mail.ReplyTo) {
+			t.Errorf("%s: got Reply-To %q, expected %q", test.name, parsed.ReplyTo, test.mail.ReplyTo)
+		}
+		if parsed.Subject != test.mail.Subject {
+			t.Errorf("%s: got Subject %q, expected %q", test.name, parsed.Subject, test.mail.Subject)
+		}
+		if parsed.Body != test.mail.Body {
+			t.Errorf("%s: got Body %q, expected %q", test.name, parsed.Body, test.mail.Body)
+		}
+		if parsed.MessageID == "" || parsed.Date.IsZero() {
+			t.Errorf("%s: missing Message-ID or Date", test.name)
+		}
+		if test.mail.MessageID != "" && parsed.MessageID != test.mail.MessageID {
+			t.Errorf("%s: got Message-ID %q, expected %q", test.name, parsed.MessageID, test.mail.MessageID)
+		}
+		if !test.mail.Date.IsZero() && !parsed.Date.Equal(test.mail.Date) {
+			t.Errorf("%s: got Date %v, expected %v", test.name, parsed.Date, test.mail.Date)
+		}
+		for name, values := range test.mail.Header {
+			got := parsed.Header[name]
+			if strings.Join(got, ",") != strings.Join(values, ",") {
+				t.Errorf("%s: got header %s %q, expected %q", test.name, name, got, values)
+			}
+		}
+
+		if len(parsed.Attachments) != len(test.mail.Attachments) {
+			t.Errorf("%s: got %d attachments, expected %d", test.name, len(parsed.Attachments), len(test.mail.Attachments))
+			continue
+		}
+		for i, a := range test.mail.Attachments {
+			got := parsed.Attachments[i]
+			if got.Name != a.Name || got.ContentType != a.ContentType || !bytes.Equal(got.Content, a.Content) {
+				t.Errorf("%s: got attachment %q %q, expected %q %q", test.name, got.Name, got.ContentType, a.Name, a.ContentType)
+			}
+		}
+	}
+}
+
+func formatted(t *testing.T, address string) string {
+	addr, err := mail.ParseAddress(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr.String()
+}
+
+func TestMailDefaultsDontModify(t *testing.T) {
+	m := &Mail{From: "alice@provider", To: "bob@provider"}
+	raw, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MessageID != "" || !m.Date.IsZero() {
+		t.Error("Bytes modified the mail")
+	}
+	parsed, err := ParseMail(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(parsed.MessageID, "@provider>") {
+		t.Errorf("Got Message-ID %q, expected one in the From domain", parsed.MessageID)
+	}
+}
+
+func TestMailHeaderInjection(t *testing.T) {
+	tests := []struct {
+		name string
+		mail *Mail
+	}{
+		{"no from", &Mail{To: "bob@provider"}},
+		{"no to", &Mail{From: "alice@provider"}},
+		{"from", &Mail{From: "alice@provider\r\nBcc: eve@provider", To: "bob@provider"}},
+		{"to", &Mail{From: "alice@provider", To: "bob@provider\nBcc: eve@provider"}},
+		{"reply-to", &Mail{From: "alice@provider", To: "bob@provider", ReplyTo: "alice@provider\r\nBcc: eve@provider"}},
+		{"message-id", &Mail{From: "alice@provider", To: "bob@provider", MessageID: "<1@provider>\r\nBcc: eve@provider"}},
+		{"header value", &Mail{From: "alice@provider", To: "bob@provider",
+			Header: mail.Header{"X-Mailer": {"katzenpost\r\nBcc: eve@provider"}}}},
+		{"header name", &Mail{From: "alice@provider", To: "bob@provider",
+			Header: mail.Header{"Bcc: eve@provider\r\nX-Mailer": {"katzenpost"}}}},
+		{"header name with colon", &Mail{From: "alice@provider", To: "bob@provider",
+			Header: mail.Header{"Bcc:": {"eve@provider"}}}},
+		{"attachment type", &Mail{From: "alice@provider", To: "bob@provider",
+			Attachments: []*Attachment{{"a.txt", "text/plain\r\nBcc: eve@provider", nil}}}},
+		{"attachment name", &Mail{From: "alice@provider", To: "bob@provider",
+			Attachments: []*Attachment{{"a.txt\r\nBcc: eve@provider", "text/plain", nil}}}},
+	}
+
+	for _, test := range tests {
+		raw, err := test.mail.Bytes()
+		if err == nil {
+			t.Errorf("%s: composed %q", test.name, raw)
+		}
+	}
+}
+
+func TestMailSubjectIsEncoded(t *testing.T) {
+	m := &Mail{From: "alice@provider", To: "bob@provider", Subject: "hello\r\nBcc: eve@provider"}
+	raw, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseMail(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := parsed.Header["Bcc"]; ok {
+		t.Error("The subject injected a Bcc header")
+	}
+}
+
+func TestMailStructuredHeadersIgnored(t *testing.T) {
+	m := &Mail{
+		From:   "alice@provider",
+		To:     "bob@provider",
+		Header: mail.Header{"to": {"eve@provider"}, "Content-Type": {"text/html"}},
+		Body:   "hello",
+	}
+	raw, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseMail(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.Header["To"]) != 1 || parsed.To != "<bob@provider>" {
+		t.Errorf("Got To %q, expected only bob", parsed.Header["To"])
+	}
+	if len(parsed.Parts) != 1 || parsed.Parts[0].ContentType != "text/plain" {
+		t.Errorf("The Content-Type header was overridden")
+	}
+}
+
+func TestParseMailParts(t *testing.T) {
+	raw := "From: alice@provider\r\n" +
+		"To: bob@provider\r\n" +
+		"Subject: =?utf-8?q?caf=C3=A9?=\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=inner\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"caf=C3=A9\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>cafe</p>\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: image/png; name=cat.png\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"bWlhdQ==\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Disposition: attachment\r\n" +
+		"\r\n" +
+		"attached text\r\n" +
+		"--outer--\r\n"
+
+	m, err := ParseMail([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Subject != "café" {
+		t.Errorf("Got Subject %q, expected café", m.Subject)
+	}
+	if m.Body != "café" {
+		t.Errorf("Got Body %q, expected café", m.Body)
+	}
+
+	expected := []struct {
+		contentType string
+		filename    string
+		isAttached  bool
+		body        string
+	}{
+		{"text/plain", "", false, "café"},
+		{"text/html", "", false, "<p>cafe</p>"},
+		{"image/png", "cat.png", true, "miau"},
+		{"text/plain", "", true, "attached text"},
+	}
+	if len(m.Parts) != len(expected) {
+		t.Fatalf("Got %d parts, expected %d", len(m.Parts), len(expected))
+	}
+	for i, e := range expected {
+		p := m.Parts[i]
+		if p.ContentType != e.contentType || p.Filename != e.filename || p.IsAttached != e.isAttached || string(p.Body) != e.body {
+			t.Errorf("Got part %d %q %q %v %q, expected %q %q %v %q", i,
+				p.ContentType, p.Filename, p.IsAttached, p.Body,
+				e.contentType, e.filename, e.isAttached, e.body)
+		}
+	}
+	if len(m.Attachments) != 2 {
+		t.Errorf("Got %d attachments, expected 2", len(m.Attachments))
+	}
+}
+
+func TestMailMaxMessageSize(t *testing.T) {
+	m := &Mail{From: "alice@provider", To: "bob@provider"}
+	half := make([]byte, MaxMessageSize/2)
+	if err := m.AddAttachment("first", "", half); err != nil {
+		t.Fatal(err)
+	}
+	if m.Attachments[0].ContentType != "application/octet-stream" {
+		t.Errorf("Got content type %q, expected application/octet-stream", m.Attachments[0].ContentType)
+	}
+	if err := m.AddAttachment("second", "", half); err != ErrMessageTooLarge {
+		t.Errorf("Got %v adding past the limit, expected ErrMessageTooLarge", err)
+	}
+	if len(m.Attachments) != 1 {
+		t.Errorf("Got %d attachments, expected the rejected one not to be added", len(m.Attachments))
+	}
+
+	// the attachments fit, but not with the body and the MIME overhead
+	m = &Mail{From: "alice@provider", To: "bob@provider"}
+	m.Attachments = []*Attachment{{"big", "application/octet-stream", make([]byte, MaxMessageSize*3/4)}}
+	if _, err := m.Bytes(); err != ErrMessageTooLarge {
+		t.Errorf("Got %v composing past the limit, expected ErrMessageTooLarge", err)
+	}
+
+	// without attachments there is no limit
+	m = &Mail{From: "alice@provider", To: "bob@provider", Body: strings.Repeat("a", MaxMessageSize*2)}
+	if _, err := m.Bytes(); err != nil {
+		t.Errorf("A big mail without attachments was rejected: %v", err)
+	}
+}
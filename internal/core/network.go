@@ -0,0 +1,249 @@
+// network.go - PKI document inspection
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	nvClient "github.com/katzenpost/authority/nonvoting/client"
+	vClient "github.com/katzenpost/authority/voting/client"
+	vConfig "github.com/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/mailproxy/config"
+)
+
+const documentFetchTimeout = 30 * time.Second
+
+// NetworkInfo describes the PKI document of the current epoch. The lambda
+// parameters are the ones of the Poisson processes used by the clients and
+// mixes, and the max delays are in milliseconds.
+type NetworkInfo struct {
+	Epoch      uint64
+	ValidFrom  time.Time
+	ValidUntil time.Time
+
+	Providers []*ProviderInfo
+
+	// MixesPerLayer is the number of mixes in every topology layer
+	MixesPerLayer []int
+
+	MixLambda       float64
+	MixMaxDelay     uint64
+	SendLambda      float64
+	SendShift       uint64
+	SendMaxInterval uint64
+}
+
+// ProviderInfo is a provider in the PKI document. Addresses are indexed by
+// transport and Kaetzchen maps the service names to their endpoints.
+type ProviderInfo struct {
+	Name        string
+	IdentityKey string
+	LinkKey     string
+	Addresses   map[string][]string
+	Kaetzchen   map[string]string
+}
+
+func newNetworkInfo(doc *pki.Document) *NetworkInfo {
+	validFrom := epochtime.Epoch.Add(time.Duration(doc.Epoch) * epochtime.Period)
+	info := &NetworkInfo{
+		Epoch:           doc.Epoch,
+		ValidFrom:       validFrom,
+		ValidUntil:      validFrom.Add(epochtime.Period),
+		MixesPerLayer:   make([]int, len(doc.Topology)),
+		MixLambda:       doc.MixLambda,
+		MixMaxDelay:     doc.MixMaxDelay,
+		SendLambda:      doc.SendLambda,
+		SendShift:       doc.SendShift,
+		SendMaxInterval: doc.SendMaxInterval,
+	}
+	for i, layer := range doc.Topology {
+		info.MixesPerLayer[i] = len(layer)
+	}
+	for _, provider := range doc.Providers {
+		info.Providers = append(info.Providers, newProviderInfo(provider))
+	}
+	sort.Slice(info.Providers, func(i, j int) bool { return info.Providers[i].Name < info.Providers[j].Name })
+	return info
+}
+
+func newProviderInfo(desc *pki.MixDescriptor) *ProviderInfo {
+	provider := &ProviderInfo{
+		Name:      desc.Name,
+		Addresses: make(map[string][]string),
+		Kaetzchen: make(map[string]string),
+	}
+	if desc.IdentityKey != nil {
+		provider.IdentityKey = desc.IdentityKey.String()
+	}
+	if desc.LinkKey != nil {
+		provider.LinkKey = desc.LinkKey.String()
+	}
+	for transport, addresses := range desc.Addresses {
+		provider.Addresses[string(transport)] = addresses
+	}
+	for service, params := range desc.Kaetzchen {
+		endpoint, _ := params["endpoint"].(string)
+		provider.Kaetzchen[service] = endpoint
+	}
+	return provider
+}
+
+// NetworkInfo returns the PKI document of the current epoch. The mailproxy
+// doesn't expose the document it uses, so the client fetches it from the
+// authority with its own PKI client and caches it until the epoch changes.
+// Right after an epoch change the authority might not have the new document
+// yet, then the one of the previous epoch is returned.
+func (c *Client) NetworkInfo() (*NetworkInfo, error) {
+	doc, err := c.documents.get(c.cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newNetworkInfo(doc), nil
+}
+
+// documentCache fetches the documents without holding the lock, concurrent
+// callers wait for the running fetch
+type documentCache struct {
+	sync.Mutex
+	client   pki.Client
+	doc      *pki.Document
+	fetching chan struct{}
+
+	// epoch returns the current epoch, it's replaced by the tests
+	epoch func() uint64
+}
+
+func (d *documentCache) currentEpoch() uint64 {
+	if d.epoch != nil {
+		return d.epoch()
+	}
+	epoch, _, _ := epochtime.Now()
+	return epoch
+}
+
+func (d *documentCache) get(cfg *Config) (*pki.Document, error) {
+	epoch := d.currentEpoch()
+
+	d.Lock()
+	for d.fetching != nil {
+		fetching := d.fetching
+		d.Unlock()
+		<-fetching
+		d.Lock()
+	}
+	if d.doc != nil && d.doc.Epoch == epoch {
+		defer d.Unlock()
+		return d.doc, nil
+	}
+	if d.client == nil {
+		client, err := cfg.newPKIClient()
+		if err != nil {
+			d.Unlock()
+			return nil, err
+		}
+		d.client = client
+	}
+	client := d.client
+	previous := d.doc
+	d.fetching = make(chan struct{})
+	d.Unlock()
+
+	doc, err := fetchDocument(cfg, client, epoch)
+
+	d.Lock()
+	defer d.Unlock()
+	close(d.fetching)
+	d.fetching = nil
+	if err != nil {
+		if previous != nil && previous.Epoch+1 == epoch {
+			return previous, nil
+		}
+		return nil, err
+	}
+	d.doc = doc
+	return doc, nil
+}
+
+func fetchDocument(cfg *Config, client pki.Client, epoch uint64) (*pki.Document, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), documentFetchTimeout)
+	defer cancel()
+	doc, rawDoc, err := client.Get(ctx, epoch)
+	if err != nil {
+		return nil, fmt.Errorf("Can't fetch the PKI document for epoch %d: %v", epoch, err)
+	}
+	if err := cfg.verifyThreshold(rawDoc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// newPKIClient connects to the authority the same way the mailproxy does,
+// through the upstream proxy. The mailproxy keeps its log backend private,
+// so the PKI client gets its own one writing to the same log file.
+func (c *Config) newPKIClient() (pki.Client, error) {
+	if c.FakeNetwork != nil {
+		return &fakePKI{c.FakeNetwork}, nil
+	}
+
+	logging := c.getLogging()
+	if logging == nil {
+		logging = &config.Logging{Disable: true, Level: "NOTICE"}
+	}
+	logBackend, err := log.New(logging.File, logging.Level, logging.Disable)
+	if err != nil {
+		return nil, err
+	}
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return c.UpstreamProxy.dial(network, address)
+	}
+
+	if len(c.Authorities) == 0 {
+		var pkiKey eddsa.PublicKey
+		if err := pkiKey.FromString(c.PkiKey); err != nil {
+			return nil, fmt.Errorf("Invalid PkiKey: %v", err)
+		}
+		return nvClient.New(&nvClient.Config{
+			LogBackend:    logBackend,
+			Address:       c.PkiAddress,
+			PublicKey:     &pkiKey,
+			DialContextFn: dial,
+		})
+	}
+
+	peers := make([]*vConfig.AuthorityPeer, len(c.Authorities))
+	for i, authority := range c.Authorities {
+		peer, err := authority.toPeer()
+		if err != nil {
+			return nil, err
+		}
+		peers[i] = peer
+	}
+	return vClient.New(&vClient.Config{
+		LogBackend:    logBackend,
+		Authorities:   peers,
+		DialContextFn: dial,
+	})
+}
@@ -0,0 +1,208 @@
+// network_test.go - PKI document tests
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/pki"
+)
+
+// testPKI wraps the fake network PKI failing the fetches when missing is
+// set, and blocking them on block when it's not nil
+type testPKI struct {
+	next pki.Client
+
+	sync.Mutex
+	epoch   uint64
+	missing bool
+	block   chan struct{}
+	started chan struct{}
+	fetches int
+}
+
+func newTestPKI(network *FakeNetwork) *testPKI {
+	return &testPKI{
+		next:    &fakePKI{network},
+		started: make(chan struct{}, 10),
+	}
+}
+
+func (p *testPKI) Get(ctx context.Context, epoch uint64) (*pki.Document, []byte, error) {
+	p.Lock()
+	p.fetches++
+	missing := p.missing
+	block := p.block
+	p.Unlock()
+
+	p.started <- struct{}{}
+	if block != nil {
+		<-block
+	}
+	if missing {
+		return nil, nil, errors.New("No document for this epoch yet")
+	}
+	return p.next.Get(ctx, epoch)
+}
+
+func (p *testPKI) currentEpoch() uint64 {
+	p.Lock()
+	defer p.Unlock()
+	return p.epoch
+}
+
+func (p *testPKI) set(epoch uint64, missing bool, block chan struct{}) {
+	p.Lock()
+	defer p.Unlock()
+	p.epoch = epoch
+	p.missing = missing
+	p.block = block
+}
+
+func (p *testPKI) fetchCount() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.fetches
+}
+
+func newTestPKIClient(t *testing.T, network *FakeNetwork, dataDir string) (*Client, *testPKI) {
+	c := newFakeClient(t, network, dataDir, "alice")
+	p := newTestPKI(network)
+	c.documents.client = p
+	c.documents.epoch = p.currentEpoch
+	return c, p
+}
+
+func checkEpoch(t *testing.T, c *Client, epoch uint64) {
+	info, err := c.NetworkInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Epoch != epoch {
+		t.Errorf("Got epoch %d, expected %d", info.Epoch, epoch)
+	}
+}
+
+func TestNetworkInfo(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+	network := NewFakeNetwork(testLatency, 0)
+	network.AddProvider("other")
+	c := newFakeClient(t, network, dataDir, "alice")
+	defer c.Shutdown()
+
+	info, err := c.NetworkInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Providers) != 2 || info.Providers[0].Name != "other" || info.Providers[1].Name != "provider" {
+		t.Fatalf("Got providers %+v, expected other and provider", info.Providers)
+	}
+	if info.Providers[1].Kaetzchen[keyserverService] == "" {
+		t.Error("The provider has no keyserver")
+	}
+	if !info.ValidUntil.After(info.ValidFrom) {
+		t.Errorf("Invalid validity from %v until %v", info.ValidFrom, info.ValidUntil)
+	}
+}
+
+func TestNetworkInfoFallback(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+	network := NewFakeNetwork(testLatency, 0)
+	c, p := newTestPKIClient(t, network, dataDir)
+	defer c.Shutdown()
+
+	p.set(5, false, nil)
+	checkEpoch(t, c, 5)
+	checkEpoch(t, c, 5)
+	if p.fetchCount() != 1 {
+		t.Errorf("The document was fetched %d times, expected it cached", p.fetchCount())
+	}
+
+	// the authority doesn't have the next document yet
+	p.set(6, true, nil)
+	checkEpoch(t, c, 5)
+
+	// but the previous one is too old after that
+	p.set(7, true, nil)
+	if _, err := c.NetworkInfo(); err == nil {
+		t.Error("Got a document two epochs old")
+	}
+
+	p.set(7, false, nil)
+	checkEpoch(t, c, 7)
+}
+
+func TestNetworkInfoFetchWithoutLock(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+	network := NewFakeNetwork(testLatency, 0)
+	c, p := newTestPKIClient(t, network, dataDir)
+	defer c.Shutdown()
+
+	block := make(chan struct{})
+	p.set(1, false, block)
+	results := make(chan error, 2)
+	go func() {
+		_, err := c.NetworkInfo()
+		results <- err
+	}()
+	select {
+	case <-p.started:
+	case <-time.After(testTimeout):
+		t.Fatal("The document was not fetched")
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		c.documents.Lock()
+		c.documents.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(testTimeout):
+		t.Fatal("The cache is locked while fetching")
+	}
+
+	// a concurrent caller waits for the running fetch
+	go func() {
+		_, err := c.NetworkInfo()
+		results <- err
+	}()
+	time.Sleep(testLatency)
+	close(block)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("NetworkInfo didn't return")
+		}
+	}
+	if p.fetchCount() != 1 {
+		t.Errorf("The document was fetched %d times, expected once", p.fetchCount())
+	}
+}
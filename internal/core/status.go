@@ -0,0 +1,138 @@
+// status.go - sent messages delivery status
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+// maxFinishedMessages is the number of sent, acknowledged or failed messages
+// we remember the status of.
+const maxFinishedMessages = 4096
+
+// ErrUnknownMessage is returned when asking the status of a message ID that
+// was not sent by this client
+var ErrUnknownMessage = errors.New("Unknown message ID")
+
+// Status is the delivery status of a sent message.
+//
+// The mailproxy emits a MessageSentEvent once every block of a message was
+// fully transmitted, or with an error if it gave up. It keeps retransmitting
+// the blocks until the recipient's provider acknowledges them but doesn't
+// report those acknowledgements, so with the mailproxy a message doesn't go
+// further than StatusSent. Backends that know when a message was delivered,
+// like FakeNetwork, move it to StatusAcknowledged.
+type Status int
+
+const (
+	// StatusQueued is a message accepted by the mailproxy but not yet
+	// fully transmitted.
+	StatusQueued Status = iota
+
+	// StatusSent is a message fully transmitted.
+	StatusSent
+
+	// StatusAcknowledged is a message acknowledged by the recipient's
+	// provider.
+	StatusAcknowledged
+
+	// StatusFailed is a message the mailproxy gave up sending.
+	StatusFailed
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusQueued:
+		return "Queued"
+	case StatusSent:
+		return "Sent"
+	case StatusAcknowledged:
+		return "Acknowledged"
+	case StatusFailed:
+		return "Failed"
+	default:
+		return "Unknown"
+	}
+}
+
+type statusTracker struct {
+	sync.Mutex
+	status   map[string]Status
+	finished []string
+}
+
+func newStatusTracker() *statusTracker {
+	return &statusTracker{status: make(map[string]Status)}
+}
+
+func (t *statusTracker) queued(messageID []byte) {
+	t.Lock()
+	defer t.Unlock()
+
+	// the sent event might race with Send returning the message ID
+	id := hex.EncodeToString(messageID)
+	if _, ok := t.status[id]; !ok {
+		t.status[id] = StatusQueued
+	}
+}
+
+func (t *statusTracker) sent(messageID []byte, err error) {
+	t.Lock()
+	defer t.Unlock()
+
+	id := hex.EncodeToString(messageID)
+	if err != nil {
+		t.status[id] = StatusFailed
+	} else {
+		t.status[id] = StatusSent
+	}
+
+	t.finished = append(t.finished, id)
+	if len(t.finished) > maxFinishedMessages {
+		delete(t.status, t.finished[0])
+		t.finished = t.finished[1:]
+	}
+}
+
+func (t *statusTracker) acked(messageID []byte) {
+	t.Lock()
+	defer t.Unlock()
+
+	// it's always reported after being sent, if it's not there it was
+	// already forgotten
+	id := hex.EncodeToString(messageID)
+	if _, ok := t.status[id]; ok {
+		t.status[id] = StatusAcknowledged
+	}
+}
+
+func (t *statusTracker) get(messageID []byte) (Status, error) {
+	t.Lock()
+	defer t.Unlock()
+	status, ok := t.status[hex.EncodeToString(messageID)]
+	if !ok {
+		return 0, ErrUnknownMessage
+	}
+	return status, nil
+}
+
+// Status returns the delivery status of a message sent by this client
+func (c *Client) Status(messageID []byte) (Status, error) {
+	return c.status.get(messageID)
+}
@@ -0,0 +1,347 @@
+// store.go - encrypted message archive
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/crypto/rand"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	storeDir     = "store"
+	storeExt     = ".msg"
+	storeParams  = "store.json"
+	storeVersion = 1
+)
+
+var (
+	// ErrStoreDisabled is returned when the message store is not configured
+	ErrStoreDisabled = errors.New("Message store is disabled")
+
+	// ErrNotInStore is returned when the message is not in the store
+	ErrNotInStore = errors.New("Message not in the store")
+)
+
+// Message directions in the store
+const (
+	DirectionReceived = "received"
+	DirectionSent     = "sent"
+)
+
+// StoredMessage is a message archived in the store, MessageID is the
+// mailproxy ID of sent messages
+type StoredMessage struct {
+	ID        string
+	Direction string
+	Account   string
+	Sender    string
+	Recipient string
+	Date      time.Time
+	MessageID []byte
+	Payload   []byte
+}
+
+// Query selects messages from the store, empty fields match everything.
+// Text is searched case insensitive in the subject and body.
+type Query struct {
+	Account   string
+	Sender    string
+	Recipient string
+	Since     time.Time
+	Until     time.Time
+	Text      string
+}
+
+// MessageStore archives the sent and received messages in the data dir
+// encrypted with a key derived from the passphrase. All the messages are
+// decrypted in memory on open so they can be searched.
+type MessageStore struct {
+	sync.Mutex
+	path     string
+	secret   *[32]byte
+	messages map[string]*StoredMessage
+}
+
+type storeParamsFile struct {
+	Version int
+	Salt    []byte
+	Check   []byte
+}
+
+func openMessageStore(dataDir, passphrase string) (*MessageStore, error) {
+	s := &MessageStore{
+		path:     path.Join(dataDir, storeDir),
+		messages: make(map[string]*StoredMessage),
+	}
+	if err := os.MkdirAll(s.path, 0700); err != nil {
+		return nil, err
+	}
+	if err := s.unlock(passphrase); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), storeExt) {
+			continue
+		}
+		msg, err := s.read(path.Join(s.path, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		s.messages[msg.ID] = msg
+	}
+	return s, nil
+}
+
+// unlock derives the store key, creating the params on first use. The check
+// box detects a wrong passphrase before touching any message.
+func (s *MessageStore) unlock(passphrase string) error {
+	paramsPath := path.Join(s.path, storeParams)
+	data, err := ioutil.ReadFile(paramsPath)
+	if os.IsNotExist(err) {
+		params := storeParamsFile{
+			Version: storeVersion,
+			Salt:    make([]byte, argonSaltLen),
+		}
+		if _, err := io.ReadFull(rand.Reader, params.Salt); err != nil {
+			return err
+		}
+		s.secret = deriveKey(passphrase, params.Salt)
+		params.Check, err = s.seal(nil)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(paramsPath, data, 0600)
+	}
+	if err != nil {
+		return err
+	}
+
+	var params storeParamsFile
+	if err := json.Unmarshal(data, &params); err != nil {
+		return err
+	}
+	if params.Version != storeVersion {
+		return errors.New("Unsupported message store version")
+	}
+	s.secret = deriveKey(passphrase, params.Salt)
+	if _, err := s.open(params.Check); err != nil {
+		return ErrWrongPassphrase
+	}
+	return nil
+}
+
+func (s *MessageStore) add(msg *StoredMessage) error {
+	id, err := newInboxID()
+	if err != nil {
+		return err
+	}
+	msg.ID = id
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	box, err := s.seal(data)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if err := ioutil.WriteFile(s.messagePath(id), box, 0600); err != nil {
+		return err
+	}
+	s.messages[id] = msg
+	return nil
+}
+
+// Get returns the message id
+func (s *MessageStore) Get(id string) (*StoredMessage, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	msg, ok := s.messages[id]
+	if !ok {
+		return nil, ErrNotInStore
+	}
+	return msg, nil
+}
+
+// Search returns the messages matching q, oldest first
+func (s *MessageStore) Search(q *Query) []*StoredMessage {
+	s.Lock()
+	defer s.Unlock()
+
+	var result []*StoredMessage
+	for _, msg := range s.messages {
+		if q.match(msg) {
+			result = append(result, msg)
+		}
+	}
+	sort.Slice(result, func(a, b int) bool { return result[a].ID < result[b].ID })
+	return result
+}
+
+// Delete removes the message id from the store
+func (s *MessageStore) Delete(id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.messages[id]; !ok {
+		return ErrNotInStore
+	}
+	if err := os.Remove(s.messagePath(id)); err != nil {
+		return err
+	}
+	delete(s.messages, id)
+	return nil
+}
+
+func (q *Query) match(msg *StoredMessage) bool {
+	if q.Account != "" && normalizeAddress(q.Account) != msg.Account {
+		return false
+	}
+	if q.Sender != "" && normalizeAddress(q.Sender) != msg.Sender {
+		return false
+	}
+	if q.Recipient != "" && normalizeAddress(q.Recipient) != msg.Recipient {
+		return false
+	}
+	if !q.Since.IsZero() && msg.Date.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && msg.Date.After(q.Until) {
+		return false
+	}
+	if q.Text != "" {
+		return strings.Contains(strings.ToLower(msg.text()), strings.ToLower(q.Text))
+	}
+	return true
+}
+
+// text returns the searchable text, the decoded subject and body if the
+// payload is a mail
+func (m *StoredMessage) text() string {
+	mail, err := ParseMail(m.Payload)
+	if err != nil {
+		return string(m.Payload)
+	}
+	return mail.Subject + "\n" + mail.Body
+}
+
+func (s *MessageStore) read(filePath string) (*StoredMessage, error) {
+	box, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.open(box)
+	if err != nil {
+		return nil, err
+	}
+	var msg StoredMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// seal encrypts data prepending the nonce
+func (s *MessageStore) seal(data []byte) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], data, &nonce, s.secret), nil
+}
+
+func (s *MessageStore) open(box []byte) ([]byte, error) {
+	if len(box) < 24 {
+		return nil, errors.New("Invalid message store box")
+	}
+	var nonce [24]byte
+	copy(nonce[:], box)
+	data, ok := secretbox.Open(nil, box[24:], &nonce, s.secret)
+	if !ok {
+		return nil, errors.New("Can't decrypt message store box")
+	}
+	return data, nil
+}
+
+func (s *MessageStore) messagePath(id string) string {
+	return path.Join(s.path, id+storeExt)
+}
+
+// MessageStore returns the message archive, it returns ErrStoreDisabled if
+// Config.StorePassphrase is not set
+func (c *Client) MessageStore() (*MessageStore, error) {
+	if c.store == nil {
+		return nil, ErrStoreDisabled
+	}
+	return c.store, nil
+}
+
+func (c *Client) archiveSent(account, recipient string, messageID, payload []byte) {
+	c.archive(&StoredMessage{
+		Direction: DirectionSent,
+		Account:   normalizeAddress(account),
+		Sender:    normalizeAddress(account),
+		Recipient: normalizeAddress(recipient),
+		MessageID: messageID,
+		Payload:   payload,
+	})
+}
+
+func (c *Client) archiveReceived(account, sender string, payload []byte) {
+	c.archive(&StoredMessage{
+		Direction: DirectionReceived,
+		Account:   account,
+		Sender:    normalizeAddress(sender),
+		Recipient: account,
+		Payload:   payload,
+	})
+}
+
+// archive failures don't stop the delivery, they are reported as events
+func (c *Client) archive(msg *StoredMessage) {
+	if c.store == nil {
+		return
+	}
+	msg.Date = time.Now()
+	if err := c.store.add(msg); err != nil {
+		c.events.push(&Event{Type: EventError, AccountID: msg.Account, Err: err})
+	}
+}
@@ -0,0 +1,232 @@
+// store_test.go - encrypted message archive tests
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+const testPassphrase = "correct horse battery staple"
+
+func storeMessages(t *testing.T, s *MessageStore) []*StoredMessage {
+	date := time.Date(2018, 5, 4, 12, 0, 0, 0, time.UTC)
+	hello, err := (&Mail{From: "alice@provider", To: "bob@provider", Subject: "Hello Bob", Body: "how are you?"}).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []*StoredMessage{
+		{Direction: DirectionSent, Account: "alice@provider", Sender: "alice@provider", Recipient: "bob@provider",
+			Date: date, MessageID: []byte{1, 2, 3}, Payload: hello},
+		{Direction: DirectionReceived, Account: "alice@provider", Sender: "bob@provider", Recipient: "alice@provider",
+			Date: date.Add(time.Hour), Payload: []byte("FINE, thanks")},
+		{Direction: DirectionReceived, Account: "carol@provider", Sender: "bob@provider", Recipient: "carol@provider",
+			Date: date.Add(2 * time.Hour), Payload: []byte("hi carol")},
+	}
+	for _, msg := range messages {
+		if err := s.add(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return messages
+}
+
+func compareStored(t *testing.T, got, expected *StoredMessage) {
+	if got.ID != expected.ID || got.Direction != expected.Direction || got.Account != expected.Account ||
+		got.Sender != expected.Sender || got.Recipient != expected.Recipient || !got.Date.Equal(expected.Date) ||
+		!bytes.Equal(got.MessageID, expected.MessageID) || !bytes.Equal(got.Payload, expected.Payload) {
+		t.Errorf("Got message %+v, expected %+v", got, expected)
+	}
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+
+	s, err := openMessageStore(dataDir, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := storeMessages(t, s)
+
+	s, err = openMessageStore(dataDir, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range messages {
+		got, err := s.Get(expected.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareStored(t, got, expected)
+	}
+
+	if err := s.Delete(messages[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(messages[0].ID); err != ErrNotInStore {
+		t.Errorf("Got %v deleting twice, expected ErrNotInStore", err)
+	}
+	s, err = openMessageStore(dataDir, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(messages[0].ID); err != ErrNotInStore {
+		t.Errorf("Got %v for a deleted message, expected ErrNotInStore", err)
+	}
+	if len(s.Search(&Query{})) != len(messages)-1 {
+		t.Errorf("Got %d messages after delete, expected %d", len(s.Search(&Query{})), len(messages)-1)
+	}
+}
+
+func TestStoreEncrypted(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+
+	s, err := openMessageStore(dataDir, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := storeMessages(t, s)
+
+	for _, msg := range messages {
+		data, err := ioutil.ReadFile(s.messagePath(msg.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, msg.Payload) || bytes.Contains(data, []byte(msg.Sender)) {
+			t.Errorf("Message %s is stored in clear", msg.ID)
+		}
+	}
+
+	if _, err := openMessageStore(dataDir, "wrong passphrase"); err != ErrWrongPassphrase {
+		t.Errorf("Got %v with a wrong passphrase, expected ErrWrongPassphrase", err)
+	}
+
+	box := s.messagePath(messages[1].ID)
+	data, err := ioutil.ReadFile(box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	if err := ioutil.WriteFile(box, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openMessageStore(dataDir, testPassphrase); err == nil {
+		t.Error("A tampered message was opened")
+	}
+}
+
+func TestStoreSearch(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+
+	s, err := openMessageStore(dataDir, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := storeMessages(t, s)
+	date := messages[0].Date
+
+	tests := []struct {
+		name     string
+		query    Query
+		expected []int
+	}{
+		{"all", Query{}, []int{0, 1, 2}},
+		{"account", Query{Account: "Alice@Provider"}, []int{0, 1}},
+		{"sender", Query{Sender: "bob@provider"}, []int{1, 2}},
+		{"recipient", Query{Recipient: "carol@provider"}, []int{2}},
+		{"since", Query{Since: date.Add(time.Minute)}, []int{1, 2}},
+		{"until", Query{Until: date.Add(time.Hour)}, []int{0, 1}},
+		{"range", Query{Since: date.Add(time.Minute), Until: date.Add(time.Hour)}, []int{1}},
+		{"subject", Query{Text: "hello bob"}, []int{0}},
+		{"body", Query{Text: "HOW ARE"}, []int{0}},
+		{"raw payload", Query{Text: "fine"}, []int{1}},
+		{"headers are not searched", Query{Text: "Message-ID"}, nil},
+		{"combined", Query{Account: "alice@provider", Sender: "bob@provider", Text: "thanks"}, []int{1}},
+		{"no match", Query{Account: "dave@provider"}, nil},
+	}
+	for _, test := range tests {
+		result := s.Search(&test.query)
+		if len(result) != len(test.expected) {
+			t.Errorf("%s: got %d messages, expected %d", test.name, len(result), len(test.expected))
+			continue
+		}
+		for i, index := range test.expected {
+			if result[i].ID != messages[index].ID {
+				t.Errorf("%s: got message %d %s, expected %s", test.name, i, result[i].ID, messages[index].ID)
+			}
+		}
+	}
+}
+
+func TestStoreArchivesMessages(t *testing.T) {
+	dataDir := tempDir(t)
+	defer os.RemoveAll(dataDir)
+	network := NewFakeNetwork(testLatency, 0)
+
+	cfg := fakeConfig(network, dataDir, "alice")
+	cfg.StorePassphrase = testPassphrase
+	alice, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Shutdown()
+	bob := newFakeClient(t, network, dataDir, "bob")
+	defer bob.Shutdown()
+
+	if _, err := bob.MessageStore(); err != ErrStoreDisabled {
+		t.Errorf("Got %v without passphrase, expected ErrStoreDisabled", err)
+	}
+
+	messageID, err := alice.Send(bob.Address(), []byte("to bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.GetMessage(testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Send(alice.Address(), []byte("to alice")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.GetMessage(testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := alice.MessageStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := store.Search(&Query{Recipient: bob.Address()})
+	if len(sent) != 1 || sent[0].Direction != DirectionSent || string(sent[0].Payload) != "to bob" ||
+		!bytes.Equal(sent[0].MessageID, messageID) {
+		t.Errorf("Got sent messages %+v", sent)
+	}
+	received := store.Search(&Query{Sender: bob.Address()})
+	if len(received) != 1 || received[0].Direction != DirectionReceived || string(received[0].Payload) != "to alice" {
+		t.Errorf("Got received messages %+v", received)
+	}
+
+	if _, err := os.Stat(path.Join(cfg.DataDir, storeDir, storeParams)); err != nil {
+		t.Errorf("The store is not in the data dir: %v", err)
+	}
+}
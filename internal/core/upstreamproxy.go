@@ -0,0 +1,155 @@
+// upstreamproxy.go - SOCKS proxy support
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/katzenpost/core/crypto/rand"
+	"golang.org/x/net/proxy"
+)
+
+// Upstream proxy types, they are the ones understood by the mailproxy
+const (
+	ProxyNone      = "none"
+	ProxySOCKS4a   = "socks4a"
+	ProxySOCKS5    = "socks5"
+	ProxyTorSOCKS5 = "tor+socks5"
+)
+
+func (p *UpstreamProxy) getType() string {
+	if p == nil || p.Type == "" {
+		return ProxyNone
+	}
+	return p.Type
+}
+
+func (p *UpstreamProxy) getNetwork() string {
+	if p.Network == "" {
+		return "tcp"
+	}
+	return p.Network
+}
+
+func (p *UpstreamProxy) validate() error {
+	switch p.getType() {
+	case ProxyNone:
+		return nil
+	case ProxySOCKS4a, ProxySOCKS5, ProxyTorSOCKS5:
+	default:
+		return fmt.Errorf("Invalid UpstreamProxy Type: %v", p.Type)
+	}
+	if p.Address == "" {
+		return errors.New("UpstreamProxy without Address")
+	}
+	if p.Password != "" && p.getType() == ProxySOCKS4a {
+		return errors.New("SOCKS4a doesn't support passwords")
+	}
+	return nil
+}
+
+// dial connects to addr through the proxy. With ProxyTorSOCKS5 every
+// connection uses random credentials if none are configured, so Tor puts
+// each one in a different circuit.
+func (p *UpstreamProxy) dial(network, addr string) (net.Conn, error) {
+	switch p.getType() {
+	case ProxySOCKS4a:
+		return p.dialSOCKS4a(network, addr)
+	case ProxySOCKS5, ProxyTorSOCKS5:
+		var auth *proxy.Auth
+		if p.User != "" {
+			auth = &proxy.Auth{User: p.User, Password: p.Password}
+		} else if p.getType() == ProxyTorSOCKS5 {
+			isolation, err := randomCredential()
+			if err != nil {
+				return nil, err
+			}
+			auth = &proxy.Auth{User: isolation, Password: isolation}
+		}
+		dialer, err := proxy.SOCKS5(p.getNetwork(), p.Address, auth, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.Dial(network, addr)
+	default:
+		return net.Dial(network, addr)
+	}
+}
+
+// dialSOCKS4a sends the host name to the proxy so it gets resolved there
+func (p *UpstreamProxy) dialSOCKS4a(network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port %v: %v", portStr, err)
+	}
+
+	conn, err := net.Dial(p.getNetwork(), p.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	// version 4, connect, port and the 0.0.0.1 address meaning 4a
+	request := []byte{4, 1, byte(port >> 8), byte(port), 0, 0, 0, 1}
+	request = append(request, p.User...)
+	request = append(request, 0)
+	request = append(request, host...)
+	request = append(request, 0)
+	if _, err := conn.Write(request); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	response := make([]byte, 8)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if response[1] != 0x5a {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS4a proxy rejected the connection: %#x", response[1])
+	}
+	return conn, nil
+}
+
+// httpClient returns an http client going through the proxy
+func (p *UpstreamProxy) httpClient() *http.Client {
+	if p.getType() == ProxyNone {
+		return &http.Client{Timeout: keyQueryTimeout}
+	}
+	return &http.Client{
+		Transport: &http.Transport{Dial: p.dial},
+		Timeout:   keyQueryTimeout,
+	}
+}
+
+func randomCredential() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
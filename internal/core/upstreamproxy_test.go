@@ -0,0 +1,347 @@
+// upstreamproxy_test.go - SOCKS proxy tests
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// socksServer is a minimal SOCKS4a and SOCKS5 proxy recording the
+// credentials and destinations of every connection
+type socksServer struct {
+	listener net.Listener
+
+	sync.Mutex
+	users        []string
+	passwords    []string
+	destinations []string
+}
+
+func newSOCKSServer(t *testing.T) *socksServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socksServer{listener: l}
+	go s.serve()
+	return s
+}
+
+func (s *socksServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *socksServer) close() {
+	s.listener.Close()
+}
+
+func (s *socksServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *socksServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	version, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+
+	var dest string
+	switch version {
+	case 4:
+		dest, err = s.handshake4a(r, conn)
+	case 5:
+		dest, err = s.handshake5(r, conn)
+	default:
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	upstream, err := net.Dial("tcp", dest)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	if version == 4 {
+		conn.Write([]byte{0, 0x5a, 0, 0, 0, 0, 0, 0})
+	} else {
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	}
+
+	go io.Copy(upstream, r)
+	io.Copy(conn, upstream)
+}
+
+func (s *socksServer) handshake4a(r *bufio.Reader, conn net.Conn) (string, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	if header[0] != 1 {
+		return "", errors.New("Not a connect request")
+	}
+	port := binary.BigEndian.Uint16(header[1:3])
+	user, err := r.ReadString(0)
+	if err != nil {
+		return "", err
+	}
+	host, err := r.ReadString(0)
+	if err != nil {
+		return "", err
+	}
+	dest := net.JoinHostPort(host[:len(host)-1], strconv.Itoa(int(port)))
+	s.record(user[:len(user)-1], "", dest)
+	return dest, nil
+}
+
+func (s *socksServer) handshake5(r *bufio.Reader, conn net.Conn) (string, error) {
+	nmethods, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	methods := make([]byte, nmethods)
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", err
+	}
+	method := byte(0)
+	for _, m := range methods {
+		if m == 2 {
+			method = 2
+		}
+	}
+	conn.Write([]byte{5, method})
+
+	var user, password string
+	if method == 2 {
+		if _, err := r.ReadByte(); err != nil {
+			return "", err
+		}
+		if user, err = readSOCKSString(r); err != nil {
+			return "", err
+		}
+		if password, err = readSOCKSString(r); err != nil {
+			return "", err
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	var host string
+	switch header[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		if host, err = readSOCKSString(r); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("Unsupported address type %d", header[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	dest := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	s.record(user, password, dest)
+	return dest, nil
+}
+
+func readSOCKSString(r *bufio.Reader) (string, error) {
+	length, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, length)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+func (s *socksServer) record(user, password, dest string) {
+	s.Lock()
+	defer s.Unlock()
+	s.users = append(s.users, user)
+	s.passwords = append(s.passwords, password)
+	s.destinations = append(s.destinations, dest)
+}
+
+func (s *socksServer) connections() ([]string, []string, []string) {
+	s.Lock()
+	defer s.Unlock()
+	return s.users, s.passwords, s.destinations
+}
+
+func newEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func echoThrough(t *testing.T, p *UpstreamProxy, addr string) {
+	conn, err := p.dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial through %v: %v", p.Type, err)
+	}
+	defer conn.Close()
+	msg := []byte("hello katzenpost")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != string(msg) {
+		t.Errorf("Got %q, expected %q", reply, msg)
+	}
+}
+
+func TestDialProxies(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	addr := net.JoinHostPort("localhost", port)
+
+	tests := []struct {
+		proxyType string
+		user      string
+		password  string
+	}{
+		{ProxySOCKS4a, "", ""},
+		{ProxySOCKS4a, "user", ""},
+		{ProxySOCKS5, "", ""},
+		{ProxySOCKS5, "user", "password"},
+		{ProxyTorSOCKS5, "user", "password"},
+	}
+	for _, test := range tests {
+		server := newSOCKSServer(t)
+		p := &UpstreamProxy{Type: test.proxyType, Address: server.addr(), User: test.user, Password: test.password}
+		if err := p.validate(); err != nil {
+			t.Fatal(err)
+		}
+		echoThrough(t, p, addr)
+		server.close()
+
+		users, passwords, destinations := server.connections()
+		if len(destinations) != 1 {
+			t.Fatalf("%v: expected 1 connection, got %d", test.proxyType, len(destinations))
+		}
+		if destinations[0] != addr {
+			t.Errorf("%v: host name was not resolved by the proxy: %v", test.proxyType, destinations[0])
+		}
+		if users[0] != test.user || passwords[0] != test.password {
+			t.Errorf("%v: wrong credentials %q:%q", test.proxyType, users[0], passwords[0])
+		}
+	}
+}
+
+func TestDialTorIsolation(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	server := newSOCKSServer(t)
+	defer server.close()
+
+	p := &UpstreamProxy{Type: ProxyTorSOCKS5, Address: server.addr()}
+	echoThrough(t, p, echo.Addr().String())
+	echoThrough(t, p, echo.Addr().String())
+
+	users, passwords, _ := server.connections()
+	if len(users) != 2 {
+		t.Fatalf("Expected 2 connections, got %d", len(users))
+	}
+	for i := range users {
+		if users[i] == "" || passwords[i] == "" {
+			t.Errorf("Connection %d without isolation credentials", i)
+		}
+	}
+	if users[0] == users[1] {
+		t.Error("Both connections used the same isolation credentials")
+	}
+}
+
+func TestHTTPClientThroughProxy(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "through the proxy")
+	}))
+	defer web.Close()
+
+	for _, proxyType := range []string{ProxySOCKS4a, ProxySOCKS5, ProxyTorSOCKS5} {
+		server := newSOCKSServer(t)
+		p := &UpstreamProxy{Type: proxyType, Address: server.addr()}
+		resp, err := p.httpClient().Get(web.URL)
+		if err != nil {
+			t.Fatalf("%v: %v", proxyType, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		server.close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "through the proxy" {
+			t.Errorf("%v: unexpected body %q", proxyType, body)
+		}
+
+		users, _, destinations := server.connections()
+		if len(destinations) == 0 {
+			t.Fatalf("%v: the request didn't go through the proxy", proxyType)
+		}
+		if proxyType == ProxyTorSOCKS5 && users[0] == "" {
+			t.Errorf("%v: no isolation credentials", proxyType)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// daemon.go - JSON-RPC daemon sharing a client
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package daemon exposes a core.Client to the local applications over
+// JSON-RPC on a Unix domain socket. Only processes of the allowed users,
+// checked with the peer credentials of the socket, can connect.
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"sync"
+
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+// ServiceName is the name the RPC methods are registered under, like
+// "Katzenpost.Send"
+const ServiceName = "Katzenpost"
+
+// Daemon serves one client to many local connections
+type Daemon struct {
+	client      *core.Client
+	listener    *net.UnixListener
+	socketPath  string
+	allowedUIDs map[uint32]bool
+	wg          sync.WaitGroup
+
+	lock     sync.Mutex
+	sessions map[*session]bool
+	claimed  map[string]bool
+	closed   bool
+}
+
+// New listens on socketPath serving client. The processes of the user
+// running the daemon are always allowed, allowedUIDs adds other users.
+func New(client *core.Client, socketPath string, allowedUIDs []uint32) (*Daemon, error) {
+	if err := checkPeerCredentialsSupport(); err != nil {
+		return nil, err
+	}
+
+	// remove a stale socket of a previous run
+	if info, err := os.Lstat(socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// anybody can connect, the peer credentials decide who gets served
+	if err := os.Chmod(socketPath, 0666); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	d := &Daemon{
+		client:      client,
+		listener:    listener,
+		socketPath:  socketPath,
+		allowedUIDs: map[uint32]bool{uint32(os.Getuid()): true},
+		sessions:    make(map[*session]bool),
+		claimed:     make(map[string]bool),
+	}
+	for _, uid := range allowedUIDs {
+		d.allowedUIDs[uid] = true
+	}
+
+	d.wg.Add(1)
+	go d.dispatchEvents()
+	return d, nil
+}
+
+// Serve accepts connections until Close is called
+func (d *Daemon) Serve() error {
+	for {
+		conn, err := d.listener.AcceptUnix()
+		if err != nil {
+			if d.isClosed() {
+				return nil
+			}
+			return err
+		}
+
+		uid, err := peerUID(conn)
+		if err != nil {
+			log.Printf("Rejecting connection, can't get the peer credentials: %v", err)
+			conn.Close()
+			continue
+		}
+		if !d.allowedUIDs[uid] {
+			log.Printf("Rejecting connection from uid %d", uid)
+			conn.Close()
+			continue
+		}
+
+		d.wg.Add(1)
+		go d.serveConn(conn)
+	}
+}
+
+func (d *Daemon) serveConn(conn *net.UnixConn) {
+	defer d.wg.Done()
+	s := newSession(d, conn)
+	if !d.addSession(s) {
+		conn.Close()
+		return
+	}
+	defer s.close()
+	defer d.removeSession(s)
+
+	server := rpc.NewServer()
+	if err := server.RegisterName(ServiceName, s); err != nil {
+		log.Printf("Can't register the RPC service: %v", err)
+		return
+	}
+	server.ServeCodec(&sessionCodec{jsonrpc.NewServerCodec(conn), s})
+}
+
+// sessionCodec removes the messages returned by GetMessage from the inbox
+// once the reply is written, so they are not lost if the connection drops
+type sessionCodec struct {
+	rpc.ServerCodec
+	session *session
+}
+
+func (c *sessionCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	err := c.ServerCodec.WriteResponse(r, body)
+	if msg, ok := body.(*Message); ok && r.Error == "" {
+		c.session.delivered(msg, err)
+	}
+	return err
+}
+
+// Close stops accepting connections and removes the socket, the client is
+// not shut down
+func (d *Daemon) Close() error {
+	d.lock.Lock()
+	if d.closed {
+		d.lock.Unlock()
+		return errors.New("Daemon already closed")
+	}
+	d.closed = true
+	for s := range d.sessions {
+		s.close()
+	}
+	d.lock.Unlock()
+
+	err := d.listener.Close()
+	os.Remove(d.socketPath)
+	return err
+}
+
+func (d *Daemon) isClosed() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.closed
+}
+
+func (d *Daemon) addSession(s *session) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed {
+		return false
+	}
+	d.sessions[s] = true
+	return true
+}
+
+func (d *Daemon) removeSession(s *session) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.sessions, s)
+}
+
+// claim reserves a message of the inbox for one GetMessage call, it returns
+// false if another call has it
+func (d *Daemon) claim(id string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.claimed[id] {
+		return false
+	}
+	d.claimed[id] = true
+	return true
+}
+
+func (d *Daemon) isClaimed(id string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.claimed[id]
+}
+
+func (d *Daemon) release(id string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.claimed, id)
+}
+
+// dispatchEvents copies every client event to the subscribed sessions
+func (d *Daemon) dispatchEvents() {
+	defer d.wg.Done()
+	for {
+		ev, err := d.client.NextEvent(0)
+		if err != nil {
+			return
+		}
+
+		d.lock.Lock()
+		for s := range d.sessions {
+			s.pushEvent(ev)
+		}
+		d.lock.Unlock()
+	}
+}
@@ -0,0 +1,345 @@
+//go:build linux
+// +build linux
+
+// daemon_test.go - JSON-RPC daemon tests
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+const (
+	testLatency = 10 * time.Millisecond
+	testTimeout = int64(5000)
+	testPayload = "hello daemon"
+)
+
+type testEnv struct {
+	dataDir string
+	network *core.FakeNetwork
+	alice   *core.Client
+	bob     *core.Client
+	daemon  *Daemon
+}
+
+func newFakeClient(t *testing.T, network *core.FakeNetwork, dataDir, user string) *core.Client {
+	c, err := core.New(&core.Config{
+		User:        user,
+		Provider:    "provider",
+		FakeNetwork: network,
+		DataDir:     path.Join(dataDir, user),
+	})
+	if err != nil {
+		t.Fatalf("Can't start %s: %v", user, err)
+	}
+	return c
+}
+
+// newTestEnv serves bob's client with a daemon without listener, the
+// connections are socketpairs passed to serveConn
+func newTestEnv(t *testing.T) *testEnv {
+	dataDir, err := ioutil.TempDir("", "katzenpost-daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	network := core.NewFakeNetwork(testLatency, 0)
+	e := &testEnv{
+		dataDir: dataDir,
+		network: network,
+		alice:   newFakeClient(t, network, dataDir, "alice"),
+		bob:     newFakeClient(t, network, dataDir, "bob"),
+	}
+	e.daemon = &Daemon{
+		client:      e.bob,
+		allowedUIDs: map[uint32]bool{uint32(os.Getuid()): true},
+		sessions:    make(map[*session]bool),
+		claimed:     make(map[string]bool),
+	}
+	e.daemon.wg.Add(1)
+	go e.daemon.dispatchEvents()
+	return e
+}
+
+func (e *testEnv) close() {
+	e.alice.Shutdown()
+	e.bob.Shutdown()
+	e.daemon.lock.Lock()
+	for s := range e.daemon.sessions {
+		s.close()
+	}
+	e.daemon.lock.Unlock()
+	e.daemon.wg.Wait()
+	os.RemoveAll(e.dataDir)
+}
+
+func socketpair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = conn.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+// connect serves a new session and returns the RPC client of it
+func (e *testEnv) connect(t *testing.T) *rpc.Client {
+	server, client := socketpair(t)
+	e.daemon.wg.Add(1)
+	go e.daemon.serveConn(server)
+	return jsonrpc.NewClient(client)
+}
+
+func (e *testEnv) waitInboxLen(t *testing.T, length int) {
+	deadline := time.Now().Add(time.Duration(testTimeout) * time.Millisecond)
+	for {
+		entries, err := e.bob.ListInbox(e.bob.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == length {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Got %d messages in the inbox, expected %d", len(entries), length)
+		}
+		time.Sleep(testLatency)
+	}
+}
+
+func TestPeerUID(t *testing.T) {
+	a, b := socketpair(t)
+	defer a.Close()
+	defer b.Close()
+	uid, err := peerUID(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid != uint32(os.Getuid()) {
+		t.Errorf("Got uid %d, expected %d", uid, os.Getuid())
+	}
+}
+
+func TestSessionSendGetMessage(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	c := e.connect(t)
+	defer c.Close()
+
+	var accounts []string
+	if err := c.Call("Katzenpost.Accounts", &Empty{}, &accounts); err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 1 || accounts[0] != e.bob.Address() {
+		t.Errorf("Got accounts %q, expected %v", accounts, e.bob.Address())
+	}
+
+	if _, err := e.alice.Send(e.bob.Address(), []byte(testPayload)); err != nil {
+		t.Fatal(err)
+	}
+	var msg Message
+	if err := c.Call("Katzenpost.GetMessage", &GetMessageArgs{Timeout: testTimeout}, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Payload) != testPayload || msg.Sender != e.alice.Address() || msg.Account != e.bob.Address() || msg.SenderKey == "" {
+		t.Errorf("Got message %+v", msg)
+	}
+	e.waitInboxLen(t, 0)
+
+	err := c.Call("Katzenpost.GetMessage", &GetMessageArgs{Timeout: 10}, &msg)
+	if err == nil || err.Error() != core.ErrTimeout.Error() {
+		t.Errorf("Got %v on an empty inbox, expected %v", err, core.ErrTimeout)
+	}
+
+	var messageID string
+	args := &SendArgs{Recipient: e.alice.Address(), Payload: []byte(testPayload)}
+	if err := c.Call("Katzenpost.Send", args, &messageID); err != nil {
+		t.Fatal(err)
+	}
+	var status string
+	if err := c.Call("Katzenpost.Status", &messageID, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status == "" {
+		t.Error("Got an empty status")
+	}
+	received, err := e.alice.GetMessage(time.Duration(testTimeout) * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(received.Payload) != testPayload || received.Sender != e.bob.Address() {
+		t.Errorf("Got message %+v", received)
+	}
+}
+
+func TestSessionSharedInbox(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	first := e.connect(t)
+	defer first.Close()
+	second := e.connect(t)
+	defer second.Close()
+
+	if _, err := e.alice.Send(e.bob.Address(), []byte(testPayload)); err != nil {
+		t.Fatal(err)
+	}
+	e.waitInboxLen(t, 1)
+
+	// only one of the connections gets the message
+	calls := []*rpc.Call{
+		first.Go("Katzenpost.GetMessage", &GetMessageArgs{Timeout: 500}, &Message{}, nil),
+		second.Go("Katzenpost.GetMessage", &GetMessageArgs{Timeout: 500}, &Message{}, nil),
+	}
+	delivered := 0
+	for _, call := range calls {
+		<-call.Done
+		switch {
+		case call.Error == nil:
+			delivered++
+		case call.Error.Error() != core.ErrTimeout.Error():
+			t.Error(call.Error)
+		}
+	}
+	if delivered != 1 {
+		t.Errorf("The message was delivered %d times, expected once", delivered)
+	}
+	e.waitInboxLen(t, 0)
+}
+
+func TestSessionClosedWhileWaiting(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	c := e.connect(t)
+
+	call := c.Go("Katzenpost.GetMessage", &GetMessageArgs{}, &Message{}, nil)
+	time.Sleep(testLatency)
+	c.Close()
+	select {
+	case <-call.Done:
+	case <-time.After(time.Duration(testTimeout) * time.Millisecond):
+		t.Fatal("GetMessage didn't return after closing the connection")
+	}
+
+	// the message arriving later stays for the next connection
+	if _, err := e.alice.Send(e.bob.Address(), []byte(testPayload)); err != nil {
+		t.Fatal(err)
+	}
+	e.waitInboxLen(t, 1)
+	c = e.connect(t)
+	defer c.Close()
+	var msg Message
+	if err := c.Call("Katzenpost.GetMessage", &GetMessageArgs{Timeout: testTimeout}, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Payload) != testPayload {
+		t.Errorf("Got payload %q, expected %q", msg.Payload, testPayload)
+	}
+}
+
+func TestSessionEvents(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	c := e.connect(t)
+	defer c.Close()
+
+	timeout := int64(10)
+	var ev Event
+	if err := c.Call("Katzenpost.NextEvent", &timeout, &ev); err == nil || err.Error() != errNotSubscribed.Error() {
+		t.Errorf("Got %v without subscribing, expected %v", err, errNotSubscribed)
+	}
+
+	if err := c.Call("Katzenpost.Subscribe", &Empty{}, &Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.alice.Send(e.bob.Address(), []byte(testPayload)); err != nil {
+		t.Fatal(err)
+	}
+	timeout = testTimeout
+	for {
+		if err := c.Call("Katzenpost.NextEvent", &timeout, &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type == core.EventMessageReceived.String() {
+			break
+		}
+	}
+	if ev.AccountID != e.bob.Address() || ev.MessageID == "" {
+		t.Errorf("Got event %+v", ev)
+	}
+
+	if err := c.Call("Katzenpost.Unsubscribe", &Empty{}, &Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Call("Katzenpost.NextEvent", &timeout, &ev); err == nil {
+		t.Error("Got an event after unsubscribing")
+	}
+}
+
+func TestSessionContacts(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	c := e.connect(t)
+	defer c.Close()
+
+	key, err := core.GenKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contact := &Contact{Address: "carol@provider", PublicKey: key.PublicKey().String()}
+	if err := c.Call("Katzenpost.AddContact", contact, &Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	var addresses []string
+	if err := c.Call("Katzenpost.ListContacts", &Empty{}, &addresses); err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 1 || addresses[0] != contact.Address {
+		t.Errorf("Got contacts %q", addresses)
+	}
+	var got Contact
+	if err := c.Call("Katzenpost.GetContact", &contact.Address, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.PublicKey != contact.PublicKey || !got.Verified {
+		t.Errorf("Got contact %+v", got)
+	}
+	if err := c.Call("Katzenpost.RemoveContact", &contact.Address, &Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Call("Katzenpost.GetContact", &contact.Address, &got); err == nil {
+		t.Error("Got a removed contact")
+	}
+}
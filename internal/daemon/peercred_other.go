@@ -0,0 +1,35 @@
+// peercred_other.go - peer credentials of unix sockets
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !linux
+// +build !linux
+
+package daemon
+
+import (
+	"errors"
+	"net"
+)
+
+var errNoPeerCredentials = errors.New("Peer credential checks are only supported on linux")
+
+func checkPeerCredentialsSupport() error {
+	return errNoPeerCredentials
+}
+
+func peerUID(conn *net.UnixConn) (uint32, error) {
+	return 0, errNoPeerCredentials
+}
@@ -0,0 +1,349 @@
+// session.go - JSON-RPC methods
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+// maxQueuedEvents is the number of events kept for a subscribed connection
+// not reading them, the oldest ones get dropped after that.
+const maxQueuedEvents = 1024
+
+var errNotSubscribed = errors.New("Not subscribed to events")
+
+// session is the RPC service of one connection, the methods follow the
+// net/rpc conventions. Timeouts are in milliseconds, 0 waits forever.
+type session struct {
+	daemon    *Daemon
+	conn      io.Closer
+	closeCh   chan struct{}
+	closeOnce sync.Once
+
+	lock       sync.Mutex
+	subscribed bool
+	events     []*Event
+	notifyCh   chan struct{}
+}
+
+func newSession(d *Daemon, conn io.Closer) *session {
+	return &session{
+		daemon:   d,
+		conn:     conn,
+		closeCh:  make(chan struct{}),
+		notifyCh: make(chan struct{}, 1),
+	}
+}
+
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+		s.conn.Close()
+	})
+}
+
+func (s *session) client() *core.Client {
+	return s.daemon.client
+}
+
+// Empty is the argument of the methods that don't need any
+type Empty struct{}
+
+// SendArgs are the arguments of Send, Account defaults to the default one
+type SendArgs struct {
+	Account   string
+	Recipient string
+	Payload   []byte
+}
+
+// Send sends a message and returns its hex encoded ID
+func (s *session) Send(args *SendArgs, messageID *string) error {
+	account := args.Account
+	if account == "" {
+		account = s.client().Address()
+	}
+	id, err := s.client().SendFrom(account, args.Recipient, args.Payload)
+	if err != nil {
+		return err
+	}
+	*messageID = hex.EncodeToString(id)
+	return nil
+}
+
+// Status returns the delivery status of a sent message
+func (s *session) Status(messageID *string, status *string) error {
+	id, err := hex.DecodeString(*messageID)
+	if err != nil {
+		return err
+	}
+	st, err := s.client().Status(id)
+	if err != nil {
+		return err
+	}
+	*status = st.String()
+	return nil
+}
+
+// GetMessageArgs are the arguments of GetMessage, Account defaults to the
+// default one
+type GetMessageArgs struct {
+	Account string
+	Timeout int64
+}
+
+// Message is a received message, Received is a unix timestamp
+type Message struct {
+	ID        string
+	Account   string
+	Sender    string
+	SenderKey string
+	Received  int64
+	Payload   []byte
+}
+
+// GetMessage returns the oldest message of the inbox, it gets removed once
+// the reply is written. The inbox is shared by all the connections.
+func (s *session) GetMessage(args *GetMessageArgs, msg *Message) error {
+	account := args.Account
+	if account == "" {
+		account = s.client().Address()
+	}
+
+	var deadline time.Time
+	if args.Timeout != 0 {
+		deadline = time.Now().Add(time.Millisecond * time.Duration(args.Timeout))
+	}
+	for {
+		var timeout time.Duration
+		if !deadline.IsZero() {
+			timeout = time.Until(deadline)
+			if timeout <= 0 {
+				return core.ErrTimeout
+			}
+		}
+		m, err := s.client().WaitMessageFor(account, timeout, s.closeCh, s.daemon.isClaimed)
+		if err != nil {
+			return err
+		}
+		// another connection might have got the same message meanwhile
+		if !s.daemon.claim(m.ID) {
+			continue
+		}
+
+		*msg = Message{
+			ID:       m.ID,
+			Account:  m.Account,
+			Sender:   m.Sender,
+			Received: m.Received.Unix(),
+			Payload:  m.Payload,
+		}
+		if m.SenderKey != nil {
+			msg.SenderKey = m.SenderKey.String()
+		}
+		return nil
+	}
+}
+
+// delivered deletes the message returned by GetMessage if the reply was
+// written, otherwise it stays in the inbox for the next call
+func (s *session) delivered(msg *Message, writeErr error) {
+	defer s.daemon.release(msg.ID)
+	if writeErr != nil {
+		return
+	}
+	if err := s.client().DeleteMessage(msg.Account, msg.ID); err != nil {
+		log.Printf("Can't delete message %s from the inbox: %v", msg.ID, err)
+	}
+}
+
+// ListProviders returns the providers in the PKI document
+func (s *session) ListProviders(_ *Empty, providers *[]string) error {
+	p, err := s.client().ListProviders()
+	*providers = p
+	return err
+}
+
+// Accounts returns the addresses of the client accounts
+func (s *session) Accounts(_ *Empty, accounts *[]string) error {
+	*accounts = s.client().Accounts()
+	return nil
+}
+
+// State returns the connection state
+func (s *session) State(_ *Empty, state *string) error {
+	*state = s.client().State().String()
+	return nil
+}
+
+// Contact is an address book entry, ChangedKey is set when a different key
+// was fetched
+type Contact struct {
+	Address    string
+	PublicKey  string
+	Verified   bool
+	ChangedKey string
+}
+
+// ListContacts returns the addresses in the address book
+func (s *session) ListContacts(_ *Empty, addresses *[]string) error {
+	*addresses = s.client().Contacts().List()
+	return nil
+}
+
+// GetContact returns the contact with address
+func (s *session) GetContact(address *string, contact *Contact) error {
+	c, ok := s.client().Contacts().Get(*address)
+	if !ok {
+		return errors.New("Unknown contact " + *address)
+	}
+	*contact = Contact{c.Address, c.PublicKey, c.Verified, c.ChangedKey}
+	return nil
+}
+
+// AddContact pins the key of a contact, replacing the previous one
+func (s *session) AddContact(contact *Contact, _ *Empty) error {
+	return s.client().Contacts().Add(contact.Address, contact.PublicKey)
+}
+
+// VerifyContact marks the key of a contact as verified by the user
+func (s *session) VerifyContact(address *string, _ *Empty) error {
+	return s.client().Contacts().Verify(*address)
+}
+
+// RemoveContact deletes a contact from the address book
+func (s *session) RemoveContact(address *string, _ *Empty) error {
+	return s.client().Contacts().Remove(*address)
+}
+
+// Event is a client notification, only the fields relevant to its Type are
+// set. MessageID is hex encoded and Error is empty on success.
+type Event struct {
+	Type        string
+	AccountID   string
+	Address     string
+	MessageID   string
+	SenderKey   string
+	Payload     []byte
+	IsConnected bool
+	State       string
+	Error       string
+}
+
+func buildEvent(ev *core.Event) *Event {
+	e := &Event{
+		Type:        ev.Type.String(),
+		AccountID:   ev.AccountID,
+		Address:     ev.Address,
+		MessageID:   hex.EncodeToString(ev.MessageID),
+		Payload:     ev.Payload,
+		IsConnected: ev.IsConnected,
+	}
+	if ev.Type == core.EventStateChanged {
+		e.State = ev.State.String()
+	}
+	if ev.SenderKey != nil {
+		e.SenderKey = ev.SenderKey.String()
+	}
+	if ev.Err != nil {
+		e.Error = ev.Err.Error()
+	}
+	return e
+}
+
+// Subscribe starts queuing the client events for this connection, every
+// subscribed connection gets all of them
+func (s *session) Subscribe(_ *Empty, _ *Empty) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.subscribed = true
+	return nil
+}
+
+// Unsubscribe stops queuing events and drops the pending ones
+func (s *session) Unsubscribe(_ *Empty, _ *Empty) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.subscribed = false
+	s.events = nil
+	return nil
+}
+
+// NextEvent returns the oldest queued event waiting up to timeout
+func (s *session) NextEvent(timeout *int64, ev *Event) error {
+	var timeoutCh <-chan time.Time
+	if *timeout != 0 {
+		timeoutCh = time.After(time.Millisecond * time.Duration(*timeout))
+	}
+
+	for {
+		e, err := s.popEvent()
+		if err != nil {
+			return err
+		}
+		if e != nil {
+			*ev = *e
+			return nil
+		}
+
+		select {
+		case <-s.notifyCh:
+		case <-timeoutCh:
+			return core.ErrTimeout
+		case <-s.closeCh:
+			return core.ErrShutdown
+		}
+	}
+}
+
+func (s *session) pushEvent(ev *core.Event) {
+	s.lock.Lock()
+	if !s.subscribed {
+		s.lock.Unlock()
+		return
+	}
+	if len(s.events) >= maxQueuedEvents {
+		s.events = s.events[1:]
+	}
+	s.events = append(s.events, buildEvent(ev))
+	s.lock.Unlock()
+
+	select {
+	case s.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (s *session) popEvent() (*Event, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.subscribed {
+		return nil, errNotSubscribed
+	}
+	if len(s.events) == 0 {
+		return nil, nil
+	}
+	ev := s.events[0]
+	s.events = s.events[1:]
+	return ev, nil
+}
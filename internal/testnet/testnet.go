@@ -0,0 +1,299 @@
+//go:build testnet
+// +build testnet
+
+// testnet.go - loopback test network
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package testnet runs a katzenpost network on loopback ports inside the
+// process for integration tests: a nonvoting authority, one mix per layer
+// and a provider with the loop and keyserver Kaetzchen services and the
+// HTTP key endpoint. Every server listens on a free port, so several
+// networks can run in parallel.
+//
+// The authority only publishes documents at epoch boundaries, build the
+// tests with the warped_epoch tag to get short epochs.
+package testnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+
+	aServer "github.com/katzenpost/authority/nonvoting/server"
+	aConfig "github.com/katzenpost/authority/nonvoting/server/config"
+	"github.com/katzenpost/bindings/internal/core"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	nServer "github.com/katzenpost/server"
+	nConfig "github.com/katzenpost/server/config"
+)
+
+const (
+	// ProviderName is the name of the provider of the test network
+	ProviderName = "provider"
+
+	numLayers = 3
+
+	logLevel = "DEBUG"
+)
+
+// Network is a running test network
+type Network struct {
+	dataDir          string
+	authority        *aServer.Server
+	authorityAddress string
+	authorityKey     *eddsa.PrivateKey
+	nodes            []*nServer.Server
+	managementPath   string
+	keyEndpoint      string
+}
+
+type node struct {
+	name       string
+	address    string
+	key        *eddsa.PrivateKey
+	isProvider bool
+}
+
+// Start launches the network keeping its state in dataDir
+func Start(dataDir string) (*Network, error) {
+	n := &Network{
+		dataDir:        dataDir,
+		managementPath: path.Join(dataDir, ProviderName, "management.sock"),
+	}
+
+	var err error
+	n.authorityKey, err = eddsa.NewKeypair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	n.authorityAddress, err = freeAddress()
+	if err != nil {
+		return nil, err
+	}
+	n.keyEndpoint, err = freeAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]*node, 0, numLayers+1)
+	for i := 0; i < numLayers; i++ {
+		nd, err := newNode(fmt.Sprintf("mix%d", i+1), false)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, nd)
+	}
+	provider, err := newNode(ProviderName, true)
+	if err != nil {
+		return nil, err
+	}
+	nodes = append(nodes, provider)
+
+	if err := n.startAuthority(nodes); err != nil {
+		return nil, err
+	}
+	for _, nd := range nodes {
+		if err := n.startNode(nd); err != nil {
+			n.Stop()
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func newNode(name string, isProvider bool) (*node, error) {
+	key, err := eddsa.NewKeypair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	address, err := freeAddress()
+	if err != nil {
+		return nil, err
+	}
+	return &node{name, address, key, isProvider}, nil
+}
+
+func (n *Network) startAuthority(nodes []*node) error {
+	dataDir := path.Join(n.dataDir, "authority")
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+
+	cfg := &aConfig.Config{
+		Authority: &aConfig.Authority{
+			Addresses: []string{n.authorityAddress},
+			DataDir:   dataDir,
+		},
+		Logging:    &aConfig.Logging{File: "katzenpost.log", Level: logLevel},
+		Parameters: &aConfig.Parameters{},
+		Debug: &aConfig.Debug{
+			IdentityKey:      n.authorityKey,
+			Layers:           numLayers,
+			MinNodesPerLayer: 1,
+		},
+	}
+	for _, nd := range nodes {
+		peer := &aConfig.Node{Identifier: nd.name, IdentityKey: nd.key.PublicKey()}
+		if nd.isProvider {
+			cfg.Providers = append(cfg.Providers, peer)
+		} else {
+			cfg.Mixes = append(cfg.Mixes, peer)
+		}
+	}
+	if err := cfg.FixupAndValidate(); err != nil {
+		return fmt.Errorf("Invalid authority config: %v", err)
+	}
+
+	var err error
+	n.authority, err = aServer.New(cfg)
+	return err
+}
+
+func (n *Network) startNode(nd *node) error {
+	dataDir := path.Join(n.dataDir, nd.name)
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+
+	cfg := &nConfig.Config{
+		Server: &nConfig.Server{
+			Identifier: nd.name,
+			Addresses:  []string{nd.address},
+			DataDir:    dataDir,
+			IsProvider: nd.isProvider,
+		},
+		Logging: &nConfig.Logging{File: "katzenpost.log", Level: logLevel},
+		PKI: &nConfig.PKI{
+			Nonvoting: &nConfig.Nonvoting{
+				Address:   n.authorityAddress,
+				PublicKey: n.authorityKey.PublicKey(),
+			},
+		},
+		Debug: &nConfig.Debug{IdentityKey: nd.key},
+	}
+	if nd.isProvider {
+		cfg.Management = &nConfig.Management{Enable: true, Path: n.managementPath}
+		cfg.Provider = &nConfig.Provider{
+			EnableUserRegistrationHTTP:    true,
+			UserRegistrationHTTPAddresses: []string{n.keyEndpoint},
+			Kaetzchen: []*nConfig.Kaetzchen{
+				{Capability: "loop", Endpoint: "+loop"},
+				{Capability: "keyserver", Endpoint: "+keyserver"},
+			},
+		}
+	}
+	if err := cfg.FixupAndValidate(); err != nil {
+		return fmt.Errorf("Invalid %s config: %v", nd.name, err)
+	}
+
+	server, err := nServer.New(cfg)
+	if err != nil {
+		return fmt.Errorf("Can't start %s: %v", nd.name, err)
+	}
+	n.nodes = append(n.nodes, server)
+	return nil
+}
+
+// Config registers user in the provider with new keys and returns a client
+// configuration for it, with its data dir inside the network one
+func (n *Network) Config(user string) (*core.Config, error) {
+	linkKey, err := core.GenKey()
+	if err != nil {
+		return nil, err
+	}
+	identityKey, err := core.GenKey()
+	if err != nil {
+		return nil, err
+	}
+
+	err = n.manage(
+		fmt.Sprintf("ADD_USER %s %s", user, linkKey.PublicKey()),
+		fmt.Sprintf("SET_USER_IDENTITY %s %s", user, identityKey.PublicKey()),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Can't register %s: %v", user, err)
+	}
+	_, port, err := net.SplitHostPort(n.keyEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	keyDiscoveryPort, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+
+	return &core.Config{
+		PkiAddress:       n.authorityAddress,
+		PkiKey:           n.authorityKey.PublicKey().String(),
+		User:             user,
+		Provider:         ProviderName,
+		IdentityKey:      identityKey,
+		LinkKey:          linkKey,
+		KeyDiscoveryPort: keyDiscoveryPort,
+		Log:              &core.LogConfig{File: "katzenpost.log", Level: logLevel, Enabled: true},
+		DataDir:          path.Join(n.dataDir, "clients", user),
+	}, nil
+}
+
+// manage sends commands to the management socket of the provider
+func (n *Network) manage(commands ...string) error {
+	conn, err := textproto.Dial("unix", n.managementPath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, _, err := conn.ReadCodeLine(220); err != nil {
+		return err
+	}
+	for _, command := range commands {
+		if err := conn.PrintfLine("%s", command); err != nil {
+			return err
+		}
+		if _, msg, err := conn.ReadCodeLine(250); err != nil {
+			return errors.New(command + ": " + msg)
+		}
+	}
+	return conn.PrintfLine("QUIT")
+}
+
+// Stop shuts down all the servers
+func (n *Network) Stop() {
+	for _, server := range n.nodes {
+		server.Shutdown()
+	}
+	n.nodes = nil
+	if n.authority != nil {
+		n.authority.Shutdown()
+		n.authority = nil
+	}
+}
+
+// freeAddress finds a free loopback port, it might be taken before the
+// server listens on it but that's unlikely in tests
+func freeAddress() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
@@ -0,0 +1,88 @@
+//go:build testnet
+// +build testnet
+
+// testnet_test.go - test network integration test
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package testnet
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+// messageTimeout leaves room for the first PKI document, build with the
+// warped_epoch tag to get it in seconds
+const messageTimeout = 5 * time.Minute
+
+func startClient(t *testing.T, n *Network, user, keyDiscovery string) *core.Client {
+	cfg, err := n.Config(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.KeyDiscovery = keyDiscovery
+	c, err := core.New(cfg)
+	if err != nil {
+		t.Fatalf("Can't start %s: %v", user, err)
+	}
+	if err := c.WaitToConnect(); err != nil {
+		c.Shutdown()
+		t.Fatalf("%s can't connect: %v", user, err)
+	}
+	return c
+}
+
+func exchange(t *testing.T, sender, recipient *core.Client, payload string) {
+	if _, err := sender.Send(recipient.Address(), []byte(payload)); err != nil {
+		t.Fatalf("%s can't send: %v", sender.Address(), err)
+	}
+	msg, err := recipient.GetMessage(messageTimeout)
+	if err != nil {
+		t.Fatalf("%s didn't get the message: %v", recipient.Address(), err)
+	}
+	if string(msg.Payload) != payload {
+		t.Errorf("Got payload %q, expected %q", msg.Payload, payload)
+	}
+	if msg.Sender != sender.Address() {
+		t.Errorf("Got sender %v, expected %v", msg.Sender, sender.Address())
+	}
+}
+
+func TestExchangeMessages(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "katzenpost-testnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	n, err := Start(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+
+	alice := startClient(t, n, "alice", core.KeyDiscoveryMixnet)
+	defer alice.Shutdown()
+	bob := startClient(t, n, "bob", core.KeyDiscoveryHTTP)
+	defer bob.Shutdown()
+
+	exchange(t, alice, bob, "hello bob")
+	exchange(t, bob, alice, "hello alice")
+}
@@ -0,0 +1,41 @@
+// account.go - mixnet client accounts
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package katzenpost
+
+import (
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+// Accounts returns the addresses of the accounts hosted by the client
+func (c *Client) Accounts() *StringList {
+	return &StringList{c.client.Accounts()}
+}
+
+// AddAccount adds a new user@provider account to the client
+func (c *Client) AddAccount(user, provider string, identityKey, linkKey *Key) error {
+	return c.client.AddAccount(&core.Account{
+		User:        user,
+		Provider:    provider,
+		IdentityKey: identityKey.private(),
+		LinkKey:     linkKey.private(),
+	})
+}
+
+// RemoveAccount removes the account with the given address from the client
+func (c *Client) RemoveAccount(address string) error {
+	return c.client.RemoveAccount(address)
+}
@@ -18,20 +18,15 @@
 package katzenpost
 
 import (
-	"errors"
+	"encoding/hex"
 	"time"
 
-	"github.com/katzenpost/core/crypto/ecdh"
-	"github.com/katzenpost/mailproxy"
-	"github.com/katzenpost/mailproxy/config"
-	"github.com/katzenpost/mailproxy/event"
+	"github.com/katzenpost/bindings/internal/core"
 )
 
-const (
-	pkiName = "default"
-)
-
-var identityKeyBytes = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+// MaxMessageSize is the biggest mail with attachments that can be composed,
+// Send and the mails without attachments are not limited
+const MaxMessageSize = core.MaxMessageSize
 
 // TimeoutError is returned on timeouts
 type TimeoutError struct{}
@@ -42,110 +37,84 @@ func (t TimeoutError) Error() string {
 
 // Client is katzenpost object
 type Client struct {
-	address   string
-	proxy     *mailproxy.Proxy
-	eventSink chan event.Event
-	recvCh    chan bool
-	connectionCh chan bool
+	client *core.Client
 }
 
 // New creates a katzenpost client
 func New(cfg *Config) (*Client, error) {
-	eventSink := make(chan event.Event)
-	dataDir, err := cfg.getDataDir()
-	if err != nil {
-		return &Client{}, err
-	}
-
-	proxyCfg := config.Config{
-		Proxy: &config.Proxy{
-			NoLaunchListeners: true,
-			DataDir:           dataDir,
-			EventSink:         eventSink,
-		},
-		Logging: cfg.getLogging(),
-		UpstreamProxy: &config.UpstreamProxy{
-			Type: "none",
-		},
-
-		NonvotingAuthority: map[string]*config.NonvotingAuthority{
-			pkiName: cfg.getAuthority(),
-		},
-		Account:    []*config.Account{cfg.getAccount()},
-		Recipients: map[string]*ecdh.PublicKey{},
-	}
-	err = proxyCfg.FixupAndValidate()
+	client, err := core.New(cfg.toCore())
 	if err != nil {
-		return &Client{}, err
+		return nil, err
 	}
-
-	recvCh := make(chan bool, 10)
-	connectionCh := make(chan bool, 10)
-	proxy, err := mailproxy.New(&proxyCfg)
-	c := &Client{cfg.getAddress(), proxy, eventSink, recvCh, connectionCh}
-	go c.eventHandler()
-	return c, err
+	return &Client{client}, nil
 }
 
 // WaitToConnect wait's to be connected
-func (c Client) WaitToConnect() error {
-	isConnected := <-c.connectionCh
-	if !isConnected {
-		return errors.New("Not connected")
-	}
-	return nil
+func (c *Client) WaitToConnect() error {
+	return c.client.WaitToConnect()
 }
 
 // Shutdown the client
-func (c Client) Shutdown() {
-	c.proxy.Shutdown()
+func (c *Client) Shutdown() {
+	c.client.Shutdown()
 }
 
-// Send a message into katzenpost
-func (c Client) Send(recipient, msg string) error {
-	var identityKey ecdh.PrivateKey
-	identityKey.FromBytes(identityKeyBytes)
-	c.proxy.SetRecipient(recipient, identityKey.PublicKey())
-	return c.proxy.SendMessage(c.address, recipient, []byte(msg))
+// Send a message into katzenpost, it returns the hex encoded message ID
+func (c *Client) Send(recipient, msg string) (string, error) {
+	return c.SendFrom(c.client.Address(), recipient, msg)
 }
 
-// Message received from katzenpost
-type Message struct {
-	Sender  string
-	Payload string
+// SendFrom sends a message into katzenpost from the given account
+func (c *Client) SendFrom(account, recipient, msg string) (string, error) {
+	return c.SendBytesFrom(account, recipient, []byte(msg))
 }
 
-// GetMessage from katzenpost
-func (c Client) GetMessage(timeout int64) (*Message, error) {
-	if timeout == 0 {
-		<-c.recvCh
-		return c.getMsg()
-	}
+// SendBytes sends a binary payload into katzenpost
+func (c *Client) SendBytes(recipient string, payload []byte) (string, error) {
+	return c.SendBytesFrom(c.client.Address(), recipient, payload)
+}
 
-	select {
-	case <-c.recvCh:
-		return c.getMsg()
-	case <-time.After(time.Second * time.Duration(timeout)):
-		return nil, nil
+// SendBytesFrom sends a binary payload into katzenpost from the given account
+func (c *Client) SendBytesFrom(account, recipient string, payload []byte) (string, error) {
+	messageID, err := c.client.SendFrom(account, recipient, payload)
+	if err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(messageID), nil
+}
+
+// Message received from katzenpost, PayloadBytes has the payload unchanged
+// for binary content. ID identifies it in the inbox and Received is a unix
+// timestamp.
+type Message struct {
+	ID           string
+	Received     int64
+	Account      string
+	Sender       string
+	Payload      string
+	PayloadBytes []byte
 }
 
-func (c Client) getMsg() (*Message, error) {
-	msg, err := c.proxy.ReceivePop(c.address)
-	return &Message{msg.SenderID, string(msg.Payload)}, err
+// GetMessage from katzenpost, timeout is in seconds. It returns nil if no
+// message arrived before the timeout.
+func (c *Client) GetMessage(timeout int64) (*Message, error) {
+	return c.GetMessageFor(c.client.Address(), timeout)
 }
 
-func (c Client) eventHandler() {
-	for {
-		ev := <-c.eventSink
-		switch ev.(type) {
-		case *event.MessageReceivedEvent:
-			c.recvCh <- true
-		case *event.ConnectionStatusEvent:
-			conEv := ev.(*event.ConnectionStatusEvent)
-			c.connectionCh <- conEv.IsConnected
-		default:
-			continue
-		}
+// GetMessageFor returns the oldest message received by account removing it
+// from the inbox, timeout is in seconds. It returns nil if no message arrived
+// before the timeout.
+func (c *Client) GetMessageFor(account string, timeout int64) (*Message, error) {
+	msg, err := c.client.GetMessageFor(account, time.Second*time.Duration(timeout))
+	if err == core.ErrTimeout {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
+	return buildMessage(msg), nil
+}
+
+func buildMessage(msg *core.Message) *Message {
+	return &Message{msg.ID, msg.Received.Unix(), msg.Account, msg.Sender, string(msg.Payload), msg.Payload}
 }
@@ -18,77 +18,177 @@
 package katzenpost
 
 import (
-	"fmt"
-	"os"
-	"path"
-
-	"github.com/katzenpost/core/crypto/ecdh"
-	"github.com/katzenpost/core/crypto/eddsa"
-	"github.com/katzenpost/mailproxy/config"
+	"github.com/katzenpost/bindings/internal/core"
 )
 
 // Config has the client configuration
 type Config struct {
-	PkiAddress string
-	PkiKey     string
-	User       string
-	Provider   string
-	LinkKey    *Key
-	Log        *LogConfig
-	DataDir    string
-}
+	PkiAddress  string
+	PkiKey      string
+	User        string
+	Provider    string
+	IdentityKey *Key
+	LinkKey     *Key
+	Log         *LogConfig
+	DataDir     string
 
-// LogConfig keeps the configuration of the loger
-type LogConfig struct {
-	File    string
-	Level   string
-	Enabled bool
+	// ProviderKeyPin is the identity key of the provider, the connection
+	// fails if it doesn't match the PKI document. StorageKey encrypts the
+	// mailproxy spool and InsecureKeyDiscovery lets the mailproxy fetch in
+	// cleartext the recipient keys of the mail sent to the SMTP listener.
+	ProviderKeyPin       string
+	StorageKey           *Key
+	InsecureKeyDiscovery bool
+
+	// KeyDiscovery is one of KeyDiscoveryMixnet (default), KeyDiscoveryHTTP
+	// or KeyDiscoveryMixnetHTTPFallback
+	KeyDiscovery string
+
+	// StorePassphrase enables the encrypted message store archiving the
+	// sent and received messages, the inbox gets encrypted with it as well
+	StorePassphrase string
+
+	// Threshold is the number of authorities added with AddAuthority that
+	// have to sign a consensus document, at least and by default a majority
+	Threshold int
+
+	// SMTPAddress and POP3Address are the loopback addresses of the
+	// listeners for mail clients, launched at start if LaunchListeners is
+	// set. They default to 127.0.0.1:2525 and 127.0.0.1:2524.
+	SMTPAddress     string
+	POP3Address     string
+	LaunchListeners bool
+
+	authorities      []*core.Authority
+	accounts         []*core.Account
+	upstreamProxy    *core.UpstreamProxy
+	backoff          *core.Backoff
+	fakeNetwork      *core.FakeNetwork
+	keyDiscoveryPort int
 }
 
-func (c Config) getAuthority() *config.NonvotingAuthority {
-	var pkiPublicKey eddsa.PublicKey
-	pkiPublicKey.FromString(c.PkiKey)
-	return &config.NonvotingAuthority{
-		Address:   c.PkiAddress,
-		PublicKey: &pkiPublicKey,
+// Key discovery modes
+const (
+	KeyDiscoveryMixnet             = core.KeyDiscoveryMixnet
+	KeyDiscoveryHTTP               = core.KeyDiscoveryHTTP
+	KeyDiscoveryMixnetHTTPFallback = core.KeyDiscoveryMixnetHTTPFallback
+)
+
+// LoadConfig reads a mailproxy TOML configuration file
+func LoadConfig(path string) (*Config, error) {
+	cfg, err := core.LoadConfig(path)
+	if err != nil {
+		return nil, err
 	}
+	return configFromCore(cfg), nil
 }
 
-func (c Config) getAccount() *config.Account {
-	var identityKey ecdh.PrivateKey
-	identityKey.FromBytes(identityKeyBytes)
-	return &config.Account{
-		User:        c.User,
-		Provider:    c.Provider,
-		Authority:   pkiName,
-		LinkKey:     c.LinkKey.priv,
-		IdentityKey: &identityKey,
-	}
+// Save writes the configuration as a mailproxy TOML configuration file, it
+// includes the private keys
+func (c *Config) Save(path string) error {
+	return c.toCore().Save(path)
 }
 
-func (c Config) getDataDir() (string, error) {
-	if c.DataDir != "" {
-		return c.DataDir, nil
-	}
+// AddAuthority adds a voting directory authority reachable on addresses to
+// the configuration, if any is added PkiAddress and PkiKey are ignored
+func (c *Config) AddAuthority(identityKey, linkKey string, addresses *StringList) {
+	c.authorities = append(c.authorities, &core.Authority{
+		IdentityKey: identityKey,
+		LinkKey:     linkKey,
+		Addresses:   addresses.list,
+	})
+}
 
-	workingDir, err := os.Getwd()
-	if err != nil {
-		return "", err
+// Upstream proxy types
+const (
+	ProxyNone      = core.ProxyNone
+	ProxySOCKS4a   = core.ProxySOCKS4a
+	ProxySOCKS5    = core.ProxySOCKS5
+	ProxyTorSOCKS5 = core.ProxyTorSOCKS5
+)
+
+// SetUpstreamProxy routes all the client connections through a SOCKS proxy,
+// proxyType is one of the Proxy constants and user and password can be
+// empty. ProxyTorSOCKS5 isolates every connection in its own Tor circuit.
+func (c *Config) SetUpstreamProxy(proxyType, address, user, password string) {
+	c.upstreamProxy = &core.UpstreamProxy{
+		Type:     proxyType,
+		Address:  address,
+		User:     user,
+		Password: password,
 	}
-	return path.Join(workingDir, "data"), nil
 }
 
-func (c Config) getLogging() *config.Logging {
-	if c.Log.Level != "" {
-		return &config.Logging{
+// LogConfig keeps the configuration of the loger
+type LogConfig struct {
+	File    string
+	Level   string
+	Enabled bool
+}
+
+func (c *Config) toCore() *core.Config {
+	cfg := &core.Config{
+		PkiAddress:           c.PkiAddress,
+		PkiKey:               c.PkiKey,
+		Authorities:          c.authorities,
+		Threshold:            c.Threshold,
+		User:                 c.User,
+		Provider:             c.Provider,
+		IdentityKey:          c.IdentityKey.private(),
+		LinkKey:              c.LinkKey.private(),
+		ProviderKeyPin:       c.ProviderKeyPin,
+		StorageKey:           c.StorageKey.private(),
+		InsecureKeyDiscovery: c.InsecureKeyDiscovery,
+		Accounts:             c.accounts,
+		KeyDiscovery:         c.KeyDiscovery,
+		KeyDiscoveryPort:     c.keyDiscoveryPort,
+		StorePassphrase:      c.StorePassphrase,
+		Backoff:              c.backoff,
+		FakeNetwork:          c.fakeNetwork,
+		SMTPAddress:          c.SMTPAddress,
+		POP3Address:          c.POP3Address,
+		LaunchListeners:      c.LaunchListeners,
+		UpstreamProxy:        c.upstreamProxy,
+		DataDir:              c.DataDir,
+	}
+	if c.Log != nil {
+		cfg.Log = &core.LogConfig{
 			File:    c.Log.File,
 			Level:   c.Log.Level,
-			Disable: !c.Log.Enabled,
+			Enabled: c.Log.Enabled,
 		}
 	}
-	return nil
+	return cfg
 }
 
-func (c Config) getAddress() string {
-	return fmt.Sprintf("%s@%s", c.User, c.Provider)
+func configFromCore(cfg *core.Config) *Config {
+	c := &Config{
+		PkiAddress:           cfg.PkiAddress,
+		PkiKey:               cfg.PkiKey,
+		User:                 cfg.User,
+		Provider:             cfg.Provider,
+		IdentityKey:          buildKey(cfg.IdentityKey),
+		LinkKey:              buildKey(cfg.LinkKey),
+		ProviderKeyPin:       cfg.ProviderKeyPin,
+		StorageKey:           buildKey(cfg.StorageKey),
+		InsecureKeyDiscovery: cfg.InsecureKeyDiscovery,
+		DataDir:              cfg.DataDir,
+		KeyDiscovery:         cfg.KeyDiscovery,
+		keyDiscoveryPort:     cfg.KeyDiscoveryPort,
+		SMTPAddress:          cfg.SMTPAddress,
+		POP3Address:          cfg.POP3Address,
+		LaunchListeners:      cfg.LaunchListeners,
+		Threshold:            cfg.Threshold,
+		authorities:          cfg.Authorities,
+		accounts:             cfg.Accounts,
+		upstreamProxy:        cfg.UpstreamProxy,
+	}
+	if cfg.Log != nil {
+		c.Log = &LogConfig{
+			File:    cfg.Log.File,
+			Level:   cfg.Log.Level,
+			Enabled: cfg.Log.Enabled,
+		}
+	}
+	return c
 }
@@ -0,0 +1,47 @@
+// fake.go - in-memory mixnet for tests
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package katzenpost
+
+import (
+	"time"
+
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+// FakeNetwork is an in-memory mixnet for application tests, clients
+// configured with SetFakeNetwork deliver messages to each other through it
+type FakeNetwork struct {
+	network *core.FakeNetwork
+}
+
+// NewFakeNetwork creates a fake network delivering messages after latency
+// milliseconds and dropping a loss fraction, between 0 and 1, of them
+func NewFakeNetwork(latency int64, loss float64) *FakeNetwork {
+	return &FakeNetwork{core.NewFakeNetwork(time.Millisecond*time.Duration(latency), loss)}
+}
+
+// AddProvider adds a provider to the fake PKI document, the providers of the
+// client accounts are added when they start
+func (n *FakeNetwork) AddProvider(name string) {
+	n.network.AddProvider(name)
+}
+
+// SetFakeNetwork makes the client use network instead of the mixnet, the
+// authority configuration is ignored
+func (c *Config) SetFakeNetwork(network *FakeNetwork) {
+	c.fakeNetwork = network.network
+}
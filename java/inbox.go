@@ -0,0 +1,71 @@
+// inbox.go - local persistent inbox
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package katzenpost
+
+// InboxEntry is the metadata of a message in the inbox, Received is a unix
+// timestamp
+type InboxEntry struct {
+	ID       string
+	Account  string
+	Sender   string
+	Received int64
+	Size     int
+	Read     bool
+}
+
+// ListInbox returns the IDs of the messages in the inbox of account, oldest
+// first. Messages stay in the inbox until DeleteMessage is called.
+func (c *Client) ListInbox(account string) (*StringList, error) {
+	entries, err := c.client.ListInbox(account)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.ID
+	}
+	return &StringList{ids}, nil
+}
+
+// GetInboxEntry returns the metadata of the message id
+func (c *Client) GetInboxEntry(account, id string) (*InboxEntry, error) {
+	entry, err := c.client.GetInboxEntry(account, id)
+	if err != nil {
+		return nil, err
+	}
+	return &InboxEntry{entry.ID, entry.Account, entry.Sender, entry.Received.Unix(), entry.Size, entry.Read}, nil
+}
+
+// PeekMessage returns the message id without removing it from the inbox
+func (c *Client) PeekMessage(account, id string) (*Message, error) {
+	msg, err := c.client.PeekMessage(account, id)
+	if err != nil {
+		return nil, err
+	}
+	return buildMessage(msg), nil
+}
+
+// DeleteMessage removes the message id from the inbox once processed
+func (c *Client) DeleteMessage(account, id string) error {
+	return c.client.DeleteMessage(account, id)
+}
+
+// UnreadCount returns the number of messages not yet read in the inbox of
+// account
+func (c *Client) UnreadCount(account string) (int, error) {
+	return c.client.UnreadCount(account)
+}
@@ -0,0 +1,47 @@
+// kaetzchen.go - provider services
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package katzenpost
+
+import (
+	"time"
+
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+// Query sends payload to a Kaetzchen service of the provider and returns
+// its reply, timeout is in seconds. It returns nil if no reply arrived before the timeout.
+func (c *Client) Query(provider, service string, payload []byte, timeout int64) ([]byte, error) {
+	return c.QueryFrom(c.client.Address(), provider, service, payload, timeout)
+}
+
+// QueryFrom sends a Kaetzchen query from the given account
+func (c *Client) QueryFrom(account, provider, service string, payload []byte, timeout int64) ([]byte, error) {
+	reply, err := c.client.QueryFrom(account, provider, service, payload, time.Second*time.Duration(timeout))
+	if err == core.ErrTimeout {
+		return nil, nil
+	}
+	return reply, err
+}
+
+// ListServices returns the Kaetzchen services advertised by the provider
+func (c *Client) ListServices(provider string) (*StringList, error) {
+	services, err := c.client.ListServices(provider)
+	if err != nil {
+		return nil, err
+	}
+	return &StringList{services}, nil
+}
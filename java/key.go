@@ -18,10 +18,8 @@
 package katzenpost
 
 import (
-	"encoding/hex"
-
+	"github.com/katzenpost/bindings/internal/core"
 	"github.com/katzenpost/core/crypto/ecdh"
-	"github.com/katzenpost/core/crypto/rand"
 )
 
 // Key keeps the key public and private data
@@ -33,7 +31,7 @@ type Key struct {
 
 // GenKey creates a new ecdh key
 func GenKey() (*Key, error) {
-	key, err := ecdh.NewKeypair(rand.Reader)
+	key, err := core.GenKey()
 	if err != nil {
 		return &Key{}, err
 	}
@@ -42,25 +40,27 @@ func GenKey() (*Key, error) {
 
 // StringToKey builds a Key from a string
 func StringToKey(keyStr string) (*Key, error) {
-	var key ecdh.PrivateKey
-
-	keyBytes, err := hex.DecodeString(keyStr)
-	if err != nil {
-		return &Key{}, err
-	}
-
-	err = key.FromBytes(keyBytes)
+	key, err := core.HexToKey(keyStr)
 	if err != nil {
 		return &Key{}, err
 	}
-
-	return buildKey(&key), nil
+	return buildKey(key), nil
 }
 
 func buildKey(key *ecdh.PrivateKey) *Key {
+	if key == nil {
+		return nil
+	}
 	return &Key{
-		Private: hex.EncodeToString(key.Bytes()),
+		Private: core.KeyToHex(key),
 		Public:  key.PublicKey().String(),
 		priv:    key,
 	}
 }
+
+func (k *Key) private() *ecdh.PrivateKey {
+	if k == nil {
+		return nil
+	}
+	return k.priv
+}
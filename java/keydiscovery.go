@@ -0,0 +1,108 @@
+// keydiscovery.go - recipient key lookup
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package katzenpost
+
+import (
+	"time"
+
+	"github.com/katzenpost/bindings/internal/core"
+	"github.com/katzenpost/core/crypto/ecdh"
+)
+
+// KeyDiscovery is implemented by the application to look up the identity
+// key of a recipient for the sending account, Get returns the public key as
+// a string
+type KeyDiscovery interface {
+	Get(account, address string) (string, error)
+}
+
+// SetKeyDiscovery replaces the way recipient keys are looked up, discovery
+// can be implemented by the application or be a BuiltinDiscovery. If
+// fallback is true the discovery selected in Config is used when discovery
+// fails. A nil discovery goes back to the one in Config.
+func (c *Client) SetKeyDiscovery(discovery KeyDiscovery, fallback bool) {
+	if discovery == nil {
+		c.client.SetKeyDiscovery(nil)
+		return
+	}
+
+	d := toCoreDiscovery(discovery)
+	if fallback {
+		d = core.ChainDiscovery(d, c.client.DefaultKeyDiscovery())
+	}
+	c.client.SetKeyDiscovery(d)
+}
+
+// BuiltinDiscovery is one of the key discoveries provided by the bindings,
+// they can be chained and cached and passed to SetKeyDiscovery
+type BuiltinDiscovery struct {
+	discovery core.KeyDiscovery
+}
+
+// Get looks up the key of address for account
+func (d *BuiltinDiscovery) Get(account, address string) (string, error) {
+	key, err := d.discovery.Get(account, address)
+	if err != nil {
+		return "", err
+	}
+	return key.String(), nil
+}
+
+// MixnetDiscovery queries the keyserver Kaetzchen service of the recipient's
+// provider through the mix network
+func (c *Client) MixnetDiscovery() *BuiltinDiscovery {
+	return &BuiltinDiscovery{core.NewMixnetDiscovery(c.client)}
+}
+
+// HTTPDiscovery fetches the keys in cleartext from the HTTP endpoint of the
+// recipient's provider, leaking who we talk to
+func (c *Client) HTTPDiscovery() *BuiltinDiscovery {
+	return &BuiltinDiscovery{core.NewHTTPDiscovery(c.client)}
+}
+
+// ChainDiscovery tries first and if it fails second, chains can be nested
+func ChainDiscovery(first, second KeyDiscovery) *BuiltinDiscovery {
+	return &BuiltinDiscovery{core.ChainDiscovery(toCoreDiscovery(first), toCoreDiscovery(second))}
+}
+
+// CacheDiscovery keeps in memory the keys found by next for ttl seconds
+func CacheDiscovery(next KeyDiscovery, ttl int64) *BuiltinDiscovery {
+	return &BuiltinDiscovery{core.CacheDiscovery(toCoreDiscovery(next), time.Second*time.Duration(ttl))}
+}
+
+func toCoreDiscovery(discovery KeyDiscovery) core.KeyDiscovery {
+	if builtin, ok := discovery.(*BuiltinDiscovery); ok {
+		return builtin.discovery
+	}
+	return discoveryAdapter{discovery}
+}
+
+type discoveryAdapter struct {
+	discovery KeyDiscovery
+}
+
+func (d discoveryAdapter) Get(account, address string) (*ecdh.PublicKey, error) {
+	keyStr, err := d.discovery.Get(account, address)
+	if err != nil {
+		return nil, err
+	}
+	var key ecdh.PublicKey
+	if err := key.FromString(keyStr); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
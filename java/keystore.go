@@ -0,0 +1,73 @@
+// keystore.go - passphrase protected key storage
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package katzenpost
+
+import (
+	"errors"
+
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+// Keystore keeps keys in the data dir encrypted with a passphrase
+type Keystore struct {
+	keystore *core.Keystore
+}
+
+// OpenKeystore opens the keystore in dataDir, an empty dataDir uses the same
+// default as Config
+func OpenKeystore(dataDir string) (*Keystore, error) {
+	keystore, err := core.OpenKeystore(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return &Keystore{keystore}, nil
+}
+
+// GenerateKey creates a new key and stores it under name
+func (k *Keystore) GenerateKey(name, passphrase string) (*Key, error) {
+	key, err := k.keystore.Generate(name, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return buildKey(key), nil
+}
+
+// StoreKey encrypts key with the passphrase and stores it under name
+func (k *Keystore) StoreKey(name, passphrase string, key *Key) error {
+	if key.private() == nil {
+		return errors.New("Key without private part")
+	}
+	return k.keystore.Store(name, passphrase, key.priv)
+}
+
+// UnlockKey decrypts the key stored under name
+func (k *Keystore) UnlockKey(name, passphrase string) (*Key, error) {
+	key, err := k.keystore.Unlock(name, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return buildKey(key), nil
+}
+
+// ListKeys returns the names of the stored keys
+func (k *Keystore) ListKeys() (*StringList, error) {
+	names, err := k.keystore.List()
+	if err != nil {
+		return nil, err
+	}
+	return &StringList{names}, nil
+}
@@ -0,0 +1,43 @@
+// list.go - lists usable from java
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package katzenpost
+
+// StringList is a list of strings, gomobile can't bind slices other than
+// []byte
+type StringList struct {
+	list []string
+}
+
+// NewStringList creates an empty list, to be filled with Add
+func NewStringList() *StringList {
+	return &StringList{}
+}
+
+// Add appends s to the list
+func (l *StringList) Add(s string) {
+	l.list = append(l.list, s)
+}
+
+// Len returns the number of strings in the list
+func (l *StringList) Len() int {
+	return len(l.list)
+}
+
+// Get returns the string at index i
+func (l *StringList) Get(i int) string {
+	return l.list[i]
+}
@@ -0,0 +1,161 @@
+// mail.go - RFC 5322 messages
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package katzenpost
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/mail"
+	"net/textproto"
+	"time"
+
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+// Mail is an email message. Fill it to send it with SendMail, received ones
+// are parsed with Message.Parse. Date is in unix time, it's set on sending
+// if zero.
+type Mail struct {
+	From      string
+	To        string
+	ReplyTo   string
+	Subject   string
+	MessageID string
+	Date      int64
+	Body      string
+
+	header      mail.Header
+	attachments []*core.Attachment
+	parts       []*core.MailPart
+}
+
+// Attachment is a file attached to a mail
+type Attachment struct {
+	Name        string
+	ContentType string
+	Content     []byte
+}
+
+// AddAttachment attaches a file to the mail, it fails if the mail gets
+// bigger than MaxMessageSize
+func (m *Mail) AddAttachment(name, contentType string, content []byte) error {
+	coreMail := core.Mail{Body: m.Body, Attachments: m.attachments}
+	if err := coreMail.AddAttachment(name, contentType, content); err != nil {
+		return err
+	}
+	m.attachments = coreMail.Attachments
+	return nil
+}
+
+// NumAttachments returns the number of files attached to the mail
+func (m *Mail) NumAttachments() int {
+	return len(m.attachments)
+}
+
+// Attachment returns the attached file i
+func (m *Mail) Attachment(i int) (*Attachment, error) {
+	if i < 0 || i >= len(m.attachments) {
+		return nil, errors.New("Attachment out of range")
+	}
+	a := m.attachments[i]
+	return &Attachment{a.Name, a.ContentType, a.Content}, nil
+}
+
+// MailPart is a decoded body part of a received mail
+type MailPart struct {
+	ContentType string
+	Filename    string
+	Body        []byte
+}
+
+// SetHeader adds a header to the mail, names are case insensitive
+func (m *Mail) SetHeader(name, value string) {
+	if m.header == nil {
+		m.header = make(mail.Header)
+	}
+	key := textproto.CanonicalMIMEHeaderKey(name)
+	m.header[key] = append(m.header[key], value)
+}
+
+// Header returns the first value of the header name, case insensitive
+func (m *Mail) Header(name string) string {
+	return m.header.Get(name)
+}
+
+// NumParts returns the number of body parts of a received mail
+func (m *Mail) NumParts() int {
+	return len(m.parts)
+}
+
+// Part returns the body part i of a received mail
+func (m *Mail) Part(i int) (*MailPart, error) {
+	if i < 0 || i >= len(m.parts) {
+		return nil, errors.New("Mail part out of range")
+	}
+	return &MailPart{m.parts[i].ContentType, m.parts[i].Filename, m.parts[i].Body}, nil
+}
+
+// Parse reads the message as an RFC 5322 mail
+func (m *Message) Parse() (*Mail, error) {
+	parsed, err := core.ParseMail(m.PayloadBytes)
+	if err != nil {
+		return nil, err
+	}
+	mail := &Mail{
+		From:        parsed.From,
+		To:          parsed.To,
+		ReplyTo:     parsed.ReplyTo,
+		Subject:     parsed.Subject,
+		MessageID:   parsed.MessageID,
+		Body:        parsed.Body,
+		header:      parsed.Header,
+		attachments: parsed.Attachments,
+		parts:       parsed.Parts,
+	}
+	if !parsed.Date.IsZero() {
+		mail.Date = parsed.Date.Unix()
+	}
+	return mail, nil
+}
+
+// SendMail sends the mail to its To address, From defaults to the client
+// address
+func (c *Client) SendMail(m *Mail) (string, error) {
+	return c.SendMailFrom(c.client.Address(), m)
+}
+
+// SendMailFrom sends the mail from the given account
+func (c *Client) SendMailFrom(account string, m *Mail) (string, error) {
+	coreMail := &core.Mail{
+		From:        m.From,
+		To:          m.To,
+		ReplyTo:     m.ReplyTo,
+		Subject:     m.Subject,
+		MessageID:   m.MessageID,
+		Header:      m.header,
+		Body:        m.Body,
+		Attachments: m.attachments,
+	}
+	if m.Date != 0 {
+		coreMail.Date = time.Unix(m.Date, 0)
+	}
+	messageID, err := c.client.SendMail(account, coreMail)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(messageID), nil
+}
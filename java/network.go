@@ -0,0 +1,125 @@
+// network.go - PKI document inspection
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package katzenpost
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+// NetworkInfo describes the PKI document of the current epoch, ValidFrom and
+// ValidUntil are unix timestamps and the max delays are in milliseconds
+type NetworkInfo struct {
+	Epoch           int64
+	ValidFrom       int64
+	ValidUntil      int64
+	MixLambda       float64
+	MixMaxDelay     int64
+	SendLambda      float64
+	SendShift       int64
+	SendMaxInterval int64
+
+	mixesPerLayer []int
+	providers     []*core.ProviderInfo
+}
+
+// ProviderInfo is a provider in the PKI document
+type ProviderInfo struct {
+	Name        string
+	IdentityKey string
+	LinkKey     string
+
+	addresses map[string][]string
+	kaetzchen map[string]string
+}
+
+// NetworkInfo returns the PKI document of the current epoch
+func (c *Client) NetworkInfo() (*NetworkInfo, error) {
+	info, err := c.client.NetworkInfo()
+	if err != nil {
+		return nil, err
+	}
+	return &NetworkInfo{
+		Epoch:           int64(info.Epoch),
+		ValidFrom:       info.ValidFrom.Unix(),
+		ValidUntil:      info.ValidUntil.Unix(),
+		MixLambda:       info.MixLambda,
+		MixMaxDelay:     int64(info.MixMaxDelay),
+		SendLambda:      info.SendLambda,
+		SendShift:       int64(info.SendShift),
+		SendMaxInterval: int64(info.SendMaxInterval),
+		mixesPerLayer:   info.MixesPerLayer,
+		providers:       info.Providers,
+	}, nil
+}
+
+// NumLayers returns the number of mix layers of the topology
+func (n *NetworkInfo) NumLayers() int {
+	return len(n.mixesPerLayer)
+}
+
+// MixesInLayer returns the number of mixes in the layer i
+func (n *NetworkInfo) MixesInLayer(i int) (int, error) {
+	if i < 0 || i >= len(n.mixesPerLayer) {
+		return 0, errors.New("Layer out of range")
+	}
+	return n.mixesPerLayer[i], nil
+}
+
+// NumProviders returns the number of providers in the document
+func (n *NetworkInfo) NumProviders() int {
+	return len(n.providers)
+}
+
+// Provider returns the provider i
+func (n *NetworkInfo) Provider(i int) (*ProviderInfo, error) {
+	if i < 0 || i >= len(n.providers) {
+		return nil, errors.New("Provider out of range")
+	}
+	p := n.providers[i]
+	return &ProviderInfo{p.Name, p.IdentityKey, p.LinkKey, p.Addresses, p.Kaetzchen}, nil
+}
+
+// Addresses returns the addresses of the provider as "transport address"
+func (p *ProviderInfo) Addresses() *StringList {
+	var addresses []string
+	for transport, list := range p.addresses {
+		for _, address := range list {
+			addresses = append(addresses, transport+" "+address)
+		}
+	}
+	sort.Strings(addresses)
+	return &StringList{addresses}
+}
+
+// Services returns the Kaetzchen services offered by the provider
+func (p *ProviderInfo) Services() *StringList {
+	services := make([]string, 0, len(p.kaetzchen))
+	for service := range p.kaetzchen {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return &StringList{services}
+}
+
+// Endpoint returns the endpoint of a Kaetzchen service, empty if the
+// provider doesn't offer it
+func (p *ProviderInfo) Endpoint(service string) string {
+	return p.kaetzchen[service]
+}
@@ -19,16 +19,15 @@
 package client
 
 import (
-	npki "github.com/katzenpost/authority/nonvoting/client"
+	"github.com/katzenpost/bindings/internal/core"
 	"github.com/katzenpost/core/crypto/eddsa"
-	"github.com/katzenpost/core/log"
-	cpki "github.com/katzenpost/core/pki"
 )
 
 // KatzenClient is katzenpost object
 type KatzenClient struct {
-	log *log.Backend
-	pki cpki.Client
+	pkiAddress string
+	pkiKey     string
+	log        *core.LogConfig
 }
 
 // LogConfig keeps the configuration of the loger
@@ -38,7 +37,7 @@ type LogConfig struct {
 	Enabled bool
 }
 
-// NewClient configures the pki to be used
+// NewKatzenClient configures the pki to be used
 func NewKatzenClient(pkiAddress, pkiKey string, logConfig *LogConfig) (*KatzenClient, error) {
 	var pubKey eddsa.PublicKey
 	err := pubKey.FromString(pkiKey)
@@ -50,17 +49,14 @@ func NewKatzenClient(pkiAddress, pkiKey string, logConfig *LogConfig) (*KatzenCl
 	if logConfig.Level != "" {
 		logLevel = logConfig.Level
 	}
-	client := new(KatzenClient)
-	client.log, err = log.New(logConfig.File, logLevel, !logConfig.Enabled)
-	if err != nil {
-		return nil, err
-	}
-
-	pkiCfg := npki.Config{
-		LogBackend: client.log,
-		Address:    pkiAddress,
-		PublicKey:  &pubKey,
+	client := &KatzenClient{
+		pkiAddress: pkiAddress,
+		pkiKey:     pkiKey,
+		log: &core.LogConfig{
+			File:    logConfig.File,
+			Level:   logLevel,
+			Enabled: logConfig.Enabled,
+		},
 	}
-	client.pki, err = npki.New(&pkiCfg)
-	return client, err
+	return client, nil
 }
@@ -18,10 +18,8 @@
 package client
 
 import (
-	"encoding/base64"
-
+	"github.com/katzenpost/bindings/internal/core"
 	"github.com/katzenpost/core/crypto/ecdh"
-	"github.com/katzenpost/core/crypto/rand"
 )
 
 // Key keeps the key public and private data
@@ -33,28 +31,15 @@ type Key struct {
 func GenKey() (*Key, error) {
 	mKey := new(Key)
 	var err error
-	mKey.priv, err = ecdh.NewKeypair(rand.Reader)
-	if err != nil {
-		return mKey, err
-	}
+	mKey.priv, err = core.GenKey()
 	return mKey, err
 }
 
-// StringToKey builds a Key from a string
+// KeyFromBase64 builds a Key from a string
 func KeyFromBase64(keyStr string) (*Key, error) {
-	var key ecdh.PrivateKey
-
-	keyBytes, err := base64.StdEncoding.DecodeString(keyStr)
+	key, err := core.Base64ToKey(keyStr)
 	if err != nil {
 		return &Key{}, err
 	}
-
-	err = key.FromBytes(keyBytes)
-	if err != nil {
-		return &Key{}, err
-	}
-	k := Key{
-		priv: &key,
-	}
-	return &k, nil
+	return &Key{priv: key}, nil
 }
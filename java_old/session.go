@@ -17,13 +17,13 @@
 package client
 
 import (
+	"encoding/hex"
 	"errors"
-	"fmt"
+	"sync"
 
-	"github.com/katzenpost/client"
+	"github.com/katzenpost/bindings/internal/core"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/minclient/block"
-	"github.com/op/go-logging"
 )
 
 // MessageConsumer is an interface used for
@@ -33,93 +33,138 @@ type MessageConsumer interface {
 	ReceivedACK(messageID *[block.MessageIDLength]byte, message []byte)
 }
 
-// StorageStub implements the Storage interface
-// as defined in the client library.
-// XXX This should be replaced by something useful.
-type StorageStub struct {
-}
-
-// GetBlocks returns a slice of blocks
-func (s *StorageStub) GetBlocks(*[block.MessageIDLength]byte) ([][]byte, error) {
-	return nil, errors.New("failure: StorageStub GetBlocks not yet implemented")
-}
-
-// PutBlock puts a block into storage
-func (s *StorageStub) PutBlock(*[block.MessageIDLength]byte, []byte) error {
-	return errors.New("failure: StorageStub PutBlock not yet implemented")
-}
-
 // Session holds the client session
 type Session struct {
-	client     *client.Client
-	log        *logging.Logger
-	clientCfg  *client.Config
-	sessionCfg *client.SessionConfig
-	session    *client.Session
+	katzen   *KatzenClient
+	user     string
+	provider string
+	linkKey  *Key
+	client   *core.Client
+	handler  *consumerHandler
+
+	sentLock sync.Mutex
+	sent     map[string][]byte
+	acked    map[string]error
 }
 
 // NewSession stablishes a session with provider using key
 func (c *KatzenClient) NewSession(user string, provider string, linkPrivKey *Key) (*Session, error) {
-	var err error
-	session := new(Session)
-	clientCfg := &client.Config{
-		User:       user,
-		Provider:   provider,
-		LinkKey:    linkPrivKey.priv,
-		LogBackend: c.log,
-		PKIClient:  c.pki,
+	session := &Session{
+		katzen:   c,
+		user:     user,
+		provider: provider,
+		linkKey:  linkPrivKey,
+		sent:     make(map[string][]byte),
+		acked:    make(map[string]error),
 	}
-	gClient, err := client.New(clientCfg)
-	if err != nil {
-		return session, err
-	}
-	session.client = gClient
-	session.log = c.log.GetLogger(fmt.Sprintf("session_%s@%s", user, provider))
-	return session, err
+	return session, nil
 }
 
 // Get returns the identity public key for a given identity.
 // This is part of the UserKeyDiscovery interface defined
 // in the client library.
-// XXX fix me
 func (s *Session) Get(identity string) (*ecdh.PublicKey, error) {
-	s.log.Debugf("Get identity %s", identity)
-	return nil, nil
+	if s.client == nil {
+		return nil, errors.New("Session is not connected")
+	}
+	return s.client.KeyDiscovery().Get(s.client.Address(), identity)
 }
 
 // Connect connects the client to the Provider
 func (s *Session) Connect(identityPrivKey *Key, messageConsumer MessageConsumer) error {
-	sessionCfg := client.SessionConfig{
-		User:             s.clientCfg.User,
-		Provider:         s.clientCfg.Provider,
-		IdentityPrivKey:  identityPrivKey.priv,
-		LinkPrivKey:      s.clientCfg.LinkKey,
-		MessageConsumer:  messageConsumer,
-		Storage:          new(StorageStub),
-		UserKeyDiscovery: s,
+	cfg := &core.Config{
+		PkiAddress:  s.katzen.pkiAddress,
+		PkiKey:      s.katzen.pkiKey,
+		User:        s.user,
+		Provider:    s.provider,
+		IdentityKey: identityPrivKey.priv,
+		LinkKey:     s.linkKey.priv,
+		Log:         s.katzen.log,
 	}
-	s.sessionCfg = &sessionCfg
 	var err error
-	s.session, err = s.client.NewSession(&sessionCfg)
-	return err
+	s.client, err = core.New(cfg)
+	if err != nil {
+		return err
+	}
+	s.handler = &consumerHandler{s, messageConsumer}
+	s.client.SetHandler(s.handler)
+	return nil
+}
+
+type consumerHandler struct {
+	session  *Session
+	consumer MessageConsumer
 }
 
+func (h *consumerHandler) ReceivedMessage(msg *core.Message) {
+	h.consumer.ReceivedMessage(msg.SenderKey, msg.Payload)
+}
+
+func (h *consumerHandler) ReceivedACK(messageID []byte, err error) {
+	h.session.sentLock.Lock()
+	id := hex.EncodeToString(messageID)
+	message, ok := h.session.sent[id]
+	if !ok {
+		// Send didn't record the ID yet, it will deliver the ACK
+		h.session.acked[id] = err
+		h.session.sentLock.Unlock()
+		return
+	}
+	delete(h.session.sent, id)
+	h.session.sentLock.Unlock()
+
+	h.deliverACK(messageID, message, err)
+}
+
+func (h *consumerHandler) deliverACK(messageID []byte, message []byte, err error) {
+	if err != nil {
+		return
+	}
+	var blockID [block.MessageIDLength]byte
+	copy(blockID[:], messageID)
+	h.consumer.ReceivedACK(&blockID, message)
+}
+
+func (h *consumerHandler) ConnectionChanged(isConnected bool, err error) {}
+
 // Shutdown the session
 func (s *Session) Shutdown() {
-	s.Shutdown()
+	if s.client != nil {
+		s.client.Shutdown()
+	}
 }
 
 // Send into the mix network
 func (s *Session) Send(recipient, provider string, msg string) error {
-	messageID, err := s.session.Send(recipient, provider, []byte(msg))
+	if s.client == nil {
+		return errors.New("Session is not connected")
+	}
+	// the lock can't be held while sending, the key discovery waits for
+	// replies delivered by the same event loop that delivers the ACKs
+	messageID, err := s.client.Send(recipient+"@"+provider, []byte(msg))
 	if err != nil {
 		return err
 	}
-	s.log.Debugf("sent message with messageID %x", messageID)
+
+	id := hex.EncodeToString(messageID)
+	s.sentLock.Lock()
+	ackErr, acked := s.acked[id]
+	if !acked {
+		s.sent[id] = []byte(msg)
+		s.sentLock.Unlock()
+		return nil
+	}
+	delete(s.acked, id)
+	s.sentLock.Unlock()
+
+	s.handler.deliverACK(messageID, []byte(msg), ackErr)
 	return nil
 }
 
 // SendUnreliable into the mix network
+//
+// The mailproxy always retransmits unacknowledged blocks, so this is the
+// same as Send.
 func (s *Session) SendUnreliable(recipient, provider string, msg string) error {
-	return s.session.SendUnreliable(recipient, provider, []byte(msg))
+	return s.Send(recipient, provider, msg)
 }
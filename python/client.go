@@ -18,23 +18,15 @@
 package katzenpost
 
 import (
-	"encoding/json"
-	"errors"
-	"net/http"
-	"net/url"
-	"strings"
+	"encoding/hex"
 	"time"
 
-	"github.com/katzenpost/core/crypto/ecdh"
-	"github.com/katzenpost/core/pki"
-	"github.com/katzenpost/mailproxy"
-	"github.com/katzenpost/mailproxy/config"
-	"github.com/katzenpost/mailproxy/event"
+	"github.com/katzenpost/bindings/internal/core"
 )
 
-const (
-	pkiName = "default"
-)
+// MaxMessageSize is the biggest mail with attachments that can be composed,
+// Send and the mails without attachments are not limited
+const MaxMessageSize = core.MaxMessageSize
 
 // TimeoutError is returned on timeouts
 type TimeoutError struct{}
@@ -45,170 +37,84 @@ func (t TimeoutError) Error() string {
 
 // Client is katzenpost object
 type Client struct {
-	address      string
-	proxy        *mailproxy.Proxy
-	eventSink    chan event.Event
-	recvCh       chan bool
-	connectionCh chan bool
+	client *core.Client
 }
 
 // New creates a katzenpost client
 func New(cfg Config) (Client, error) {
-	eventSink := make(chan event.Event)
-	dataDir, err := cfg.getDataDir()
-	if err != nil {
-		return Client{}, err
-	}
-
-	proxyCfg := config.Config{
-		Proxy: &config.Proxy{
-			NoLaunchListeners: true,
-			DataDir:           dataDir,
-			EventSink:         eventSink,
-		},
-		Logging: cfg.getLogging(),
-		UpstreamProxy: &config.UpstreamProxy{
-			Type: "none",
-		},
-
-		NonvotingAuthority: map[string]*config.NonvotingAuthority{
-			pkiName: cfg.getAuthority(),
-		},
-		Account:    []*config.Account{cfg.getAccount()},
-		Recipients: map[string]*ecdh.PublicKey{},
-	}
-	err = proxyCfg.FixupAndValidate()
-	if err != nil {
-		return Client{}, err
-	}
-
-	recvCh := make(chan bool, 10)
-	connectionCh := make(chan bool, 10)
-	proxy, err := mailproxy.New(&proxyCfg)
-	c := Client{cfg.getAddress(), proxy, eventSink, recvCh, connectionCh}
-	go c.eventHandler()
-	return c, err
+	client, err := core.New(cfg.toCore())
+	return Client{client}, err
 }
 
 // WaitToConnect wait's to be connected
 func (c Client) WaitToConnect() error {
-	isConnected := <-c.connectionCh
-	if !isConnected {
-		return errors.New("Not connected")
-	}
-	return nil
+	return c.client.WaitToConnect()
 }
 
 // ListProviders returns the provider list
 func (c Client) ListProviders() ([]string, error) {
-	providers, err := c.proxy.ListProviders(pkiName)
-	if err != nil {
-		return nil, err
-	}
-
-	names := make([]string, len(providers))
-	for i, provider := range providers {
-		names[i] = provider.Name
-	}
-	return names, nil
+	return c.client.ListProviders()
 }
 
 // Shutdown the client
 func (c Client) Shutdown() {
-	c.proxy.Shutdown()
+	c.client.Shutdown()
 }
 
-// Send a message into katzenpost
-func (c Client) Send(recipient, msg string) error {
-	err := c.fetchKey(recipient)
-	if err != nil {
-		return err
-	}
-	return c.proxy.SendMessage(c.address, recipient, []byte(msg))
+// Send a message into katzenpost, it returns the hex encoded message ID
+func (c Client) Send(recipient, msg string) (string, error) {
+	return c.SendFrom(c.client.Address(), recipient, msg)
 }
 
-func (c Client) fetchKey(address string) error {
-	parts := strings.Split(address, "@")
-	if len(parts) != 2 {
-		return errors.New("Not valid address address: " + address)
-	}
-	user := strings.ToLower(parts[0])
-	providerName := parts[1]
-
-	providers, err := c.proxy.ListProviders(pkiName)
-	if err != nil {
-		return err
-	}
-	providerAddress := ""
-	for _, provider := range providers {
-		if provider.Name == providerName {
-			addr := provider.Addresses[pki.TransportTCPv4][0]
-			providerAddress = strings.Split(addr, ":")[0]
-			break
-		}
-	}
-	if providerAddress == "" {
-		return errors.New("Recipient provider doesn't exist in the authority document: " + providerName)
-	}
+// SendFrom sends a message into katzenpost from the given account
+func (c Client) SendFrom(account, recipient, msg string) (string, error) {
+	return c.SendBytesFrom(account, recipient, []byte(msg))
+}
 
-	resp, err := http.PostForm("http://"+providerAddress+":7900/getidkey", url.Values{"user": {user}})
-	if err != nil {
-		return errors.New("Can't fetch key for address: " + err.Error())
-	}
-	defer resp.Body.Close()
+// SendBytes sends a binary payload into katzenpost
+func (c Client) SendBytes(recipient string, payload []byte) (string, error) {
+	return c.SendBytesFrom(c.client.Address(), recipient, payload)
+}
 
-	decoder := json.NewDecoder(resp.Body)
-	var response struct {
-		Getidkey string
-	}
-	err = decoder.Decode(&response)
+// SendBytesFrom sends a binary payload into katzenpost from the given account
+func (c Client) SendBytesFrom(account, recipient string, payload []byte) (string, error) {
+	messageID, err := c.client.SendFrom(account, recipient, payload)
 	if err != nil {
-		return errors.New("There was a problem reading the key fetch response: " + err.Error())
+		return "", err
 	}
-
-	var key ecdh.PublicKey
-	key.FromString(response.Getidkey)
-	c.proxy.SetRecipient(address, &key)
-	return nil
+	return hex.EncodeToString(messageID), nil
 }
 
-// Message received from katzenpost
+// Message received from katzenpost, PayloadBytes has the payload unchanged
+// for binary content. ID identifies it in the inbox and Received is a unix
+// timestamp.
 type Message struct {
-	Sender  string
-	Payload string
+	ID           string
+	Received     int64
+	Account      string
+	Sender       string
+	Payload      string
+	PayloadBytes []byte
 }
 
-// GetMessage from katzenpost
+// GetMessage from katzenpost, timeout is in milliseconds
 func (c Client) GetMessage(timeout int64) (Message, error) {
-	if timeout == 0 {
-		<-c.recvCh
-		return c.getMsg()
-	}
+	return c.GetMessageFor(c.client.Address(), timeout)
+}
 
-	select {
-	case <-c.recvCh:
-		return c.getMsg()
-	case <-time.After(time.Millisecond * time.Duration(timeout)):
+// GetMessageFor returns the oldest message received by account removing it
+// from the inbox, timeout is in milliseconds
+func (c Client) GetMessageFor(account string, timeout int64) (Message, error) {
+	msg, err := c.client.GetMessageFor(account, time.Millisecond*time.Duration(timeout))
+	if err == core.ErrTimeout {
 		return Message{}, TimeoutError{}
 	}
+	if err != nil {
+		return Message{}, err
+	}
+	return buildMessage(msg), nil
 }
 
-func (c Client) getMsg() (Message, error) {
-	msg, err := c.proxy.ReceivePop(c.address)
-	return Message{msg.SenderID, string(msg.Payload)}, err
-}
-
-func (c Client) eventHandler() {
-	for {
-		ev := <-c.eventSink
-		switch ev.(type) {
-		case *event.MessageReceivedEvent:
-			c.recvCh <- true
-		case *event.ConnectionStatusEvent:
-			conEv := ev.(*event.ConnectionStatusEvent)
-			c.connectionCh <- conEv.IsConnected
-		default:
-			continue
-		}
-	}
+func buildMessage(msg *core.Message) Message {
+	return Message{msg.ID, msg.Received.Unix(), msg.Account, msg.Sender, string(msg.Payload), msg.Payload}
 }
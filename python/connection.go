@@ -0,0 +1,59 @@
+// connection.go - connection state and reconnection
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package katzenpost
+
+import (
+	"time"
+
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+// Connection states
+const (
+	StateConnecting   = int(core.StateConnecting)
+	StateConnected    = int(core.StateConnected)
+	StateDisconnected = int(core.StateDisconnected)
+	StateBackingOff   = int(core.StateBackingOff)
+	StateShutdown     = int(core.StateShutdown)
+)
+
+// State returns the connection state, one of the State constants. Changes
+// are notified as EventStateChanged events.
+func (c Client) State() int {
+	return int(c.client.State())
+}
+
+// StateName returns the name of the connection state
+func (c Client) StateName() string {
+	return c.client.State().String()
+}
+
+// Reconnect restarts the connection right away resetting the backoff, call
+// it when the network changes
+func (c Client) Reconnect() error {
+	return c.client.Reconnect()
+}
+
+// SetBackoff configures the delay between reconnections, initial and max are
+// in milliseconds. Zero values use the defaults.
+func (c *Config) SetBackoff(initial, max int64, multiplier float64) {
+	c.backoff = &core.Backoff{
+		Initial:    time.Millisecond * time.Duration(initial),
+		Max:        time.Millisecond * time.Duration(max),
+		Multiplier: multiplier,
+	}
+}
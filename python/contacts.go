@@ -0,0 +1,60 @@
+// contacts.go - recipient address book
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package katzenpost
+
+import (
+	"errors"
+)
+
+// Contact is a recipient with its pinned key, ChangedKey is set when a
+// different key was fetched and the messages to it are blocked
+type Contact struct {
+	Address    string
+	PublicKey  string
+	Verified   bool
+	ChangedKey string
+}
+
+// ListContacts returns the addresses in the address book
+func (c Client) ListContacts() []string {
+	return c.client.Contacts().List()
+}
+
+// GetContact returns the contact with address
+func (c Client) GetContact(address string) (Contact, error) {
+	contact, ok := c.client.Contacts().Get(address)
+	if !ok {
+		return Contact{}, errors.New("Unknown contact " + address)
+	}
+	return Contact{contact.Address, contact.PublicKey, contact.Verified, contact.ChangedKey}, nil
+}
+
+// AddContact pins publicKey as the key of address, replacing the previous
+// one. This is the way to accept a key change.
+func (c Client) AddContact(address, publicKey string) error {
+	return c.client.Contacts().Add(address, publicKey)
+}
+
+// VerifyContact marks the pinned key of address as verified by the user
+func (c Client) VerifyContact(address string) error {
+	return c.client.Contacts().Verify(address)
+}
+
+// RemoveContact deletes address from the address book
+func (c Client) RemoveContact(address string) error {
+	return c.client.Contacts().Remove(address)
+}
@@ -0,0 +1,85 @@
+// event.go - mixnet client events
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package katzenpost
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+// Event types
+const (
+	EventConnectionStatus = int(core.EventConnectionStatus)
+	EventMessageReceived  = int(core.EventMessageReceived)
+	EventMessageSent      = int(core.EventMessageSent)
+	EventKaetzchenReply   = int(core.EventKaetzchenReply)
+	EventError            = int(core.EventError)
+	EventKeyChanged       = int(core.EventKeyChanged)
+	EventStateChanged     = int(core.EventStateChanged)
+)
+
+// Event is a notification from the client, only the fields relevant to its
+// Type are set. MessageID is hex encoded, PayloadBytes has the Kaetzchen reply
+// unchanged for binary content and Error is empty on success.
+type Event struct {
+	Type         int
+	TypeName     string
+	AccountID    string
+	Address      string
+	MessageID    string
+	SenderKey    string
+	Payload      string
+	PayloadBytes []byte
+	IsConnected  bool
+	State        int
+	Error        string
+}
+
+// NextEvent returns the next client event, timeout is in milliseconds
+func (c Client) NextEvent(timeout int64) (Event, error) {
+	ev, err := c.client.NextEvent(time.Millisecond * time.Duration(timeout))
+	if err == core.ErrTimeout {
+		return Event{}, TimeoutError{}
+	}
+	if err != nil {
+		return Event{}, err
+	}
+	return buildEvent(ev), nil
+}
+
+func buildEvent(ev *core.Event) Event {
+	e := Event{
+		Type:         int(ev.Type),
+		TypeName:     ev.Type.String(),
+		AccountID:    ev.AccountID,
+		Address:      ev.Address,
+		MessageID:    hex.EncodeToString(ev.MessageID),
+		Payload:      string(ev.Payload),
+		PayloadBytes: ev.Payload,
+		IsConnected:  ev.IsConnected,
+		State:        int(ev.State),
+	}
+	if ev.SenderKey != nil {
+		e.SenderKey = ev.SenderKey.String()
+	}
+	if ev.Err != nil {
+		e.Error = ev.Err.Error()
+	}
+	return e
+}
@@ -0,0 +1,63 @@
+// handler.go - mixnet client callbacks
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package katzenpost
+
+import (
+	"encoding/hex"
+
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+// MessageHandler is implemented by the application to get notified of
+// received messages, delivery ACKs and connection changes
+type MessageHandler interface {
+	ReceivedMessage(msg Message)
+	// ReceivedACK gets the hex encoded message ID and an error
+	// description, empty if the message was delivered
+	ReceivedACK(messageID string, err string)
+	ConnectionChanged(isConnected bool)
+}
+
+// SetHandler registers the handler to be called on every client event,
+// received messages are not returned by GetMessage while it is set
+func (c Client) SetHandler(handler MessageHandler) {
+	if handler == nil {
+		c.client.SetHandler(nil)
+		return
+	}
+	c.client.SetHandler(handlerAdapter{handler})
+}
+
+type handlerAdapter struct {
+	handler MessageHandler
+}
+
+func (h handlerAdapter) ReceivedMessage(msg *core.Message) {
+	h.handler.ReceivedMessage(buildMessage(msg))
+}
+
+func (h handlerAdapter) ReceivedACK(messageID []byte, err error) {
+	errStr := ""
+	if err != nil {
+		errStr = err.Error()
+	}
+	h.handler.ReceivedACK(hex.EncodeToString(messageID), errStr)
+}
+
+func (h handlerAdapter) ConnectionChanged(isConnected bool, err error) {
+	h.handler.ConnectionChanged(isConnected)
+}
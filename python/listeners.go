@@ -0,0 +1,34 @@
+// listeners.go - local SMTP and POP3 listeners
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package katzenpost
+
+// StartListeners launches the SMTP and POP3 listeners so mail clients can
+// use the accounts. While they run the received messages are left for the
+// POP3 clients instead of being moved to the inbox.
+func (c Client) StartListeners() error {
+	return c.client.StartListeners()
+}
+
+// StopListeners closes the SMTP and POP3 listeners
+func (c Client) StopListeners() error {
+	return c.client.StopListeners()
+}
+
+// ListenersRunning reports if the SMTP and POP3 listeners are launched
+func (c Client) ListenersRunning() bool {
+	return c.client.ListenersRunning()
+}
@@ -0,0 +1,42 @@
+// status.go - sent messages delivery status
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package katzenpost
+
+import (
+	"encoding/hex"
+
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+// Delivery status of sent messages
+const (
+	StatusQueued       = int(core.StatusQueued)
+	StatusSent         = int(core.StatusSent)
+	StatusAcknowledged = int(core.StatusAcknowledged)
+	StatusFailed       = int(core.StatusFailed)
+)
+
+// Status returns the delivery status of the message with the hex encoded
+// messageID returned by Send
+func (c Client) Status(messageID string) (int, error) {
+	id, err := hex.DecodeString(messageID)
+	if err != nil {
+		return 0, err
+	}
+	status, err := c.client.Status(id)
+	return int(status), err
+}
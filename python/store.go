@@ -0,0 +1,98 @@
+// store.go - encrypted message archive
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package katzenpost
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/katzenpost/bindings/internal/core"
+)
+
+// Message directions in the store
+const (
+	DirectionReceived = core.DirectionReceived
+	DirectionSent     = core.DirectionSent
+)
+
+// StoredMessage is a message archived in the store, Date is a unix timestamp
+// and MessageID the hex encoded ID of sent messages
+type StoredMessage struct {
+	ID           string
+	Direction    string
+	Account      string
+	Sender       string
+	Recipient    string
+	Date         int64
+	MessageID    string
+	Payload      string
+	PayloadBytes []byte
+}
+
+// SearchMessages returns the IDs of the stored messages matching all the
+// non empty arguments, oldest first. since and until are unix timestamps,
+// 0 doesn't limit the date. text is searched in the subject and body.
+func (c Client) SearchMessages(account, sender, recipient string, since, until int64, text string) ([]string, error) {
+	store, err := c.client.MessageStore()
+	if err != nil {
+		return nil, err
+	}
+	messages := store.Search(buildQuery(account, sender, recipient, since, until, text))
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	return ids, nil
+}
+
+// GetStoredMessage returns the stored message id
+func (c Client) GetStoredMessage(id string) (StoredMessage, error) {
+	store, err := c.client.MessageStore()
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	msg, err := store.Get(id)
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	return StoredMessage{msg.ID, msg.Direction, msg.Account, msg.Sender, msg.Recipient, msg.Date.Unix(), hex.EncodeToString(msg.MessageID), string(msg.Payload), msg.Payload}, nil
+}
+
+// DeleteStoredMessage removes the message id from the store
+func (c Client) DeleteStoredMessage(id string) error {
+	store, err := c.client.MessageStore()
+	if err != nil {
+		return err
+	}
+	return store.Delete(id)
+}
+
+func buildQuery(account, sender, recipient string, since, until int64, text string) *core.Query {
+	q := &core.Query{
+		Account:   account,
+		Sender:    sender,
+		Recipient: recipient,
+		Text:      text,
+	}
+	if since != 0 {
+		q.Since = time.Unix(since, 0)
+	}
+	if until != 0 {
+		q.Until = time.Unix(until, 0)
+	}
+	return q
+}
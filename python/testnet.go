@@ -0,0 +1,55 @@
+// testnet.go - loopback test network
+// Copyright (C) 2018  Ruben Pollan.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build testnet
+// +build testnet
+
+package katzenpost
+
+import (
+	"github.com/katzenpost/bindings/internal/testnet"
+)
+
+// TestNetwork is a katzenpost network running on loopback ports inside the
+// process, for integration tests. It's only built with the testnet tag, and
+// needs the warped_epoch tag as well to get a PKI document quickly.
+type TestNetwork struct {
+	network *testnet.Network
+}
+
+// StartTestNetwork launches the authority, mixes and provider keeping their
+// state in dataDir
+func StartTestNetwork(dataDir string) (TestNetwork, error) {
+	network, err := testnet.Start(dataDir)
+	if err != nil {
+		return TestNetwork{}, err
+	}
+	return TestNetwork{network}, nil
+}
+
+// Config registers user in the provider and returns its client configuration
+func (n TestNetwork) Config(user string) (Config, error) {
+	cfg, err := n.network.Config(user)
+	if err != nil {
+		return Config{}, err
+	}
+	return configFromCore(cfg), nil
+}
+
+// Stop shuts down the network
+func (n TestNetwork) Stop() {
+	n.network.Stop()
+}